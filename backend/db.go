@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	docclient "github.com/david-callender/FoodFinder/utils/dineocclient"
+	"github.com/david-callender/FoodFinder/utils/mailer"
+	"github.com/david-callender/FoodFinder/utils/matcher"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -20,20 +24,39 @@ type User struct {
 	Email       string
 	Password    []byte
 	DisplayName string
+	// nil until the user follows the link in their verification email
+	VerifiedAt *time.Time
 }
 
 type MealWithPreference struct {
 	Meal        string `json:"meal"`
 	IsPreferred bool   `json:"isPreferred"`
 	Id          string `json:"id"`
+	// Left out for meals nobody has rated.
+	Rating *RatingSummary `json:"rating,omitempty"`
 }
 
 type Server struct {
 	DB       *pgxpool.Pool
-	LoggedIn map[int]bool
+	Keys     *KeySet
+	Sessions SessionStore
+	Mailer   mailer.Sender
+	Logins   LoginGuard
+	// nil when OIDC login isn't configured
+	OIDC *OIDCProvider
+	// used for menus missing from the cache
+	Dineoc *docclient.Client
 }
 
+// The SQLSTATE postgres fails a statement with when it breaks a unique index.
+const UNIQUE_VIOLATION = "23505"
+
+// The unique index that keeps two users from having the same email.
+const USERS_EMAIL_INDEX = "Users_email_lower_idx"
+
 var ErrEmailInUse = errors.New("email already in use")
+var ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+var ErrInvalidVerifyToken = errors.New("invalid or expired email verification token")
 var ErrInvalidPeriodName = errors.New("invalid period name")
 
 var periodNameToNum map[string]int = map[string]int{
@@ -67,7 +90,7 @@ func connectDB() (*pgxpool.Pool, error) {
 func EmailExists(db *pgxpool.Pool, email string) (bool, error) {
 	var exists bool
 	err := db.QueryRow(context.Background(),
-		`SELECT EXISTS (SELECT 1 FROM "Users" WHERE "email"=$1)`,
+		`SELECT EXISTS (SELECT 1 FROM "Users" WHERE lower("email")=lower($1))`,
 		email,
 	).Scan(&exists)
 
@@ -78,6 +101,12 @@ func EmailExists(db *pgxpool.Pool, email string) (bool, error) {
 	return exists, nil
 }
 
+// Reports whether err is a statement breaking the unique index named index.
+func isUniqueViolation(err error, index string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == UNIQUE_VIOLATION && pgErr.ConstraintName == index
+}
+
 // Adds a new user to the users table.
 func AddNewUser(db *pgxpool.Pool, email string, password []byte, displayName string) (int, error) {
 	exists, err := EmailExists(db, email)
@@ -94,22 +123,27 @@ func AddNewUser(db *pgxpool.Pool, email string, password []byte, displayName str
 		VALUES ($1, $2, $3)
 		RETURNING "id"`, email, password, displayName).Scan(&id)
 
-	if err != nil {
+	// The check above is only a courtesy, since someone else can sign up with
+	// the same email between it and the insert. The unique index catches that.
+	if isUniqueViolation(err, USERS_EMAIL_INDEX) {
+		return -1, ErrEmailInUse
+	} else if err != nil {
 		return -1, fmt.Errorf("failed to insert new user: %w", err)
 	}
 	return id, nil
 }
 
-// Finds a user by an email.
+// Finds a user by an email. Emails are compared case-insensitively, like the
+// unique index on them.
 func GetByEmail(db *pgxpool.Pool, email string) (*User, error) {
 	var user User
 
-	user.Email = email
-
 	err := db.QueryRow(context.Background(),
-		`SELECT "id", "password", "displayName" FROM "Users" WHERE "email"=$1`,
+		`SELECT "id", "email", "password", "displayName", "verifiedAt"
+			FROM "Users"
+			WHERE lower("email")=lower($1)`,
 		email,
-	).Scan(&user.ID, &user.Password, &user.DisplayName)
+	).Scan(&user.ID, &user.Email, &user.Password, &user.DisplayName, &user.VerifiedAt)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -121,7 +155,236 @@ func GetByEmail(db *pgxpool.Pool, email string) (*User, error) {
 	return &user, nil
 }
 
-func GetCacheMenu(db *pgxpool.Pool, locationId string, periodName string, date time.Time) ([]MealWithPreference, error) {
+// Finds a user by their ID.
+func GetById(db *pgxpool.Pool, uid int) (*User, error) {
+	var user User
+
+	user.ID = uid
+
+	err := db.QueryRow(context.Background(),
+		`SELECT "email", "password", "displayName", "verifiedAt" FROM "Users" WHERE "id"=$1`,
+		uid,
+	).Scan(&user.Email, &user.Password, &user.DisplayName, &user.VerifiedAt)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Updates the given fields of a user's account. nil fields are left as they
+// are. Changing the email marks the user as unverified again.
+func UpdateUser(db *pgxpool.Pool, uid int, email *string, displayName *string, password []byte) error {
+	if email != nil {
+		var taken bool
+		err := db.QueryRow(context.Background(),
+			`SELECT EXISTS (SELECT 1 FROM "Users" WHERE lower("email")=lower($1) AND "id"<>$2)`,
+			*email, uid,
+		).Scan(&taken)
+		if err != nil {
+			return fmt.Errorf("failed to check for existing user: %w", err)
+		}
+		if taken {
+			return ErrEmailInUse
+		}
+	}
+
+	_, err := db.Exec(context.Background(), `
+		UPDATE "Users" SET
+			"verifiedAt"=CASE
+				WHEN $2::text IS NOT NULL AND $2::text <> "email" THEN NULL
+				ELSE "verifiedAt"
+			END,
+			"email"=coalesce($2, "email"),
+			"displayName"=coalesce($3, "displayName"),
+			"password"=coalesce($4, "password")
+		WHERE "id"=$1`, uid, email, displayName, password)
+
+	// Like in AddNewUser, a concurrent change can claim the email between the
+	// check and the update.
+	if isUniqueViolation(err, USERS_EMAIL_INDEX) {
+		return ErrEmailInUse
+	} else if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// Deletes a user along with their preferences. Sessions and outstanding email
+// links are removed by the database when the user row goes away.
+func DeleteUser(db *pgxpool.Pool, uid int) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), `DELETE FROM "Preferences" WHERE "user"=$1`, uid)
+	if err != nil {
+		return fmt.Errorf("failed to delete preferences: %w", err)
+	}
+
+	_, err = tx.Exec(context.Background(), `DELETE FROM "Users" WHERE "id"=$1`, uid)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// Stores the hash of a password reset token for a user.
+func AddPasswordReset(db *pgxpool.Pool, uid int, tokenHash string, expiresAt time.Time) error {
+	_, err := db.Exec(context.Background(), `
+		INSERT INTO "PasswordResets" ("tokenHash", "user", "expiresAt")
+		VALUES ($1, $2, $3)`, tokenHash, uid, expiresAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert password reset: %w", err)
+	}
+	return nil
+}
+
+// Finds when a user was last sent a password reset link. Returns the zero time
+// if they never were.
+func LastPasswordReset(db *pgxpool.Pool, uid int) (time.Time, error) {
+	var last *time.Time
+	err := db.QueryRow(context.Background(),
+		`SELECT max("createdAt") FROM "PasswordResets" WHERE "user"=$1`,
+		uid,
+	).Scan(&last)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get last password reset: %w", err)
+	}
+	if last == nil {
+		return time.Time{}, nil
+	}
+	return *last, nil
+}
+
+// Redeems a password reset token and sets the user's password. Every other
+// outstanding reset token for the user is thrown away as well. Returns the ID
+// of the user whose password was changed, or ErrInvalidResetToken if the token
+// is unknown, expired or already used.
+func RedeemPasswordReset(db *pgxpool.Pool, tokenHash string, password []byte) (int, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var uid int
+	err = tx.QueryRow(context.Background(), `
+		UPDATE "PasswordResets"
+			SET "usedAt"=now()
+			WHERE "tokenHash"=$1 AND "usedAt" IS NULL AND "expiresAt" > now()
+			RETURNING "user"`, tokenHash).Scan(&uid)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -1, ErrInvalidResetToken
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to redeem password reset: %w", err)
+	}
+
+	_, err = tx.Exec(context.Background(),
+		`UPDATE "Users" SET "password"=$2 WHERE "id"=$1`, uid, password)
+	if err != nil {
+		return -1, fmt.Errorf("failed to update password: %w", err)
+	}
+
+	_, err = tx.Exec(context.Background(),
+		`DELETE FROM "PasswordResets" WHERE "user"=$1 AND "usedAt" IS NULL`, uid)
+	if err != nil {
+		return -1, fmt.Errorf("failed to clear password resets: %w", err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return -1, err
+	}
+	return uid, nil
+}
+
+// Stores the hash of an email verification token for the address a user
+// currently has.
+func AddEmailVerification(db *pgxpool.Pool, uid int, email string, tokenHash string, expiresAt time.Time) error {
+	_, err := db.Exec(context.Background(), `
+		INSERT INTO "EmailVerifications" ("tokenHash", "user", "email", "expiresAt")
+		VALUES ($1, $2, $3, $4)`, tokenHash, uid, email, expiresAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert email verification: %w", err)
+	}
+	return nil
+}
+
+// Finds when a user was last sent a verification email. Returns the zero time
+// if they never were.
+func LastEmailVerification(db *pgxpool.Pool, uid int) (time.Time, error) {
+	var last *time.Time
+	err := db.QueryRow(context.Background(),
+		`SELECT max("createdAt") FROM "EmailVerifications" WHERE "user"=$1`,
+		uid,
+	).Scan(&last)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get last email verification: %w", err)
+	}
+	if last == nil {
+		return time.Time{}, nil
+	}
+	return *last, nil
+}
+
+// Redeems an email verification token and marks the user as verified. The
+// token only counts if the user's email hasn't changed since it was sent.
+// Returns the ID of the verified user, or ErrInvalidVerifyToken if the token
+// is unknown, expired or already used.
+func RedeemEmailVerification(db *pgxpool.Pool, tokenHash string) (int, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var uid int
+	var email string
+	err = tx.QueryRow(context.Background(), `
+		UPDATE "EmailVerifications"
+			SET "usedAt"=now()
+			WHERE "tokenHash"=$1 AND "usedAt" IS NULL AND "expiresAt" > now()
+			RETURNING "user", "email"`, tokenHash).Scan(&uid, &email)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return -1, ErrInvalidVerifyToken
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to redeem email verification: %w", err)
+	}
+
+	tag, err := tx.Exec(context.Background(), `
+		UPDATE "Users"
+			SET "verifiedAt"=coalesce("verifiedAt", now())
+			WHERE "id"=$1 AND "email"=$2`, uid, email)
+	if err != nil {
+		return -1, fmt.Errorf("failed to mark user verified: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return -1, ErrInvalidVerifyToken
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return -1, err
+	}
+	return uid, nil
+}
+
+// Gets a menu from the cache, falling back to asking dineoncampus through
+// client if it isn't cached. The fallback request is canceled along with ctx,
+// or once it has taken DINEOC_DEADLINE.
+func GetCacheMenu(ctx context.Context, db *pgxpool.Pool, client *docclient.Client, locationId string, periodName string, date time.Time) ([]MealWithPreference, error) {
 	menu := make([]MealWithPreference, 0)
 	dateFormatted := date.Format(time.DateOnly)
 
@@ -130,7 +393,7 @@ func GetCacheMenu(db *pgxpool.Pool, locationId string, periodName string, date t
 	}
 
 	menuRows, err := db.Query(
-		context.Background(),
+		ctx,
 		`SELECT "meal", "mealid"
 			FROM "DocCache"
 			WHERE "day"=$1
@@ -154,7 +417,9 @@ func GetCacheMenu(db *pgxpool.Pool, locationId string, periodName string, date t
 	}
 	if len(menu) == 0 {
 		log.Println("Missed Cache, using dineocclient directly")
-		doccMenu, err := docclient.GetMenuById(locationId, periodName, date)
+		ctx, cancel := context.WithTimeout(ctx, DINEOC_DEADLINE)
+		defer cancel()
+		doccMenu, err := client.GetMenuById(ctx, locationId, periodName, date)
 
 		if err != nil {
 			return nil, err
@@ -172,33 +437,265 @@ func GetCacheMenu(db *pgxpool.Pool, locationId string, periodName string, date t
 	return menu, nil
 }
 
-// Produces a map of preferences to true for a given user.
-func GetUserPrefs(db *pgxpool.Pool, uid int) (map[string]bool, error) {
-	prefs := make(map[string]bool)
+// Menus grouped by day (YYYY-MM-DD), then location ID, then period name.
+type MenusByDay map[string]map[string]map[string][]MealWithPreference
+
+// Finds the name of a period from its number in the db.
+func periodNumToName(num int) string {
+	for name, n := range periodNameToNum {
+		if n == num {
+			return name
+		}
+	}
+	return ""
+}
 
+// Gets every cached menu from the days between from and to (inclusive) for
+// the given locations and periods in a single query. An empty locationIds
+// means every location. Unlike GetCacheMenu, this doesn't fall back to
+// dineocclient for menus that aren't cached.
+func GetCacheMenus(db *pgxpool.Pool, from time.Time, to time.Time, locationIds []string, periodNames []string) (MenusByDay, error) {
+	periodNums := make([]int, 0, len(periodNames))
+	for _, periodName := range periodNames {
+		num, ok := periodNameToNum[periodName]
+		if !ok {
+			return nil, ErrInvalidPeriodName
+		}
+		periodNums = append(periodNums, num)
+	}
+
+	menuRows, err := db.Query(
+		context.Background(),
+		`SELECT "day"::text, "location", "mealtime", "meal", "mealid"
+			FROM "DocCache"
+			WHERE "day" BETWEEN $1 AND $2
+			AND (cardinality($3::text[]) = 0 OR "location" = ANY($3))
+			AND "mealtime" = ANY($4)
+			ORDER BY "day", "location", "mealtime"`,
+		from.Format(time.DateOnly), to.Format(time.DateOnly), locationIds, periodNums,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetCacheMenus: failed db query: %v", err)
+	}
+	defer menuRows.Close()
+
+	menus := make(MenusByDay)
+	for menuRows.Next() {
+		var day, location string
+		var mealtime int
+		var meal MealWithPreference
+		err = menuRows.Scan(&day, &location, &mealtime, &meal.Meal, &meal.Id)
+		if err != nil {
+			return nil, fmt.Errorf("GetCacheMenus: failed reading row: %v", err)
+		}
+
+		if menus[day] == nil {
+			menus[day] = make(map[string]map[string][]MealWithPreference)
+		}
+		if menus[day][location] == nil {
+			menus[day][location] = make(map[string][]MealWithPreference)
+		}
+		period := periodNumToName(mealtime)
+		menus[day][location][period] = append(menus[day][location][period], meal)
+	}
+	if err = menuRows.Err(); err != nil {
+		return nil, fmt.Errorf("GetCacheMenus: failed reading rows: %v", err)
+	}
+
+	return menus, nil
+}
+
+// A time and place a meal is served.
+type MealOccurrence struct {
+	MealId       string `json:"mealId"`
+	Day          string `json:"day"`
+	Location     string `json:"location"`
+	LocationName string `json:"locationName"`
+	Mealtime     string `json:"mealtime"`
+}
+
+// A preferred meal and everywhere it's served.
+type UpcomingFavorite struct {
+	Meal        string           `json:"meal"`
+	Occurrences []MealOccurrence `json:"occurrences"`
+}
+
+// Finds every time a meal matching prefs is served between from and to
+// (inclusive). Meals are ordered by when they're next served, and each meal's
+// occurrences are in chronological order.
+func GetUpcomingFavorites(db *pgxpool.Pool, prefs *matcher.Matcher, from time.Time, to time.Time) ([]UpcomingFavorite, error) {
+	// Rules can be regexes, so rather than matching in SQL we go through
+	// every meal in the range. That's at most a few thousand rows.
+	rows, err := db.Query(
+		context.Background(),
+		`SELECT "DocCache"."meal", "DocCache"."mealid", "DocCache"."day"::text, "DocCache"."location",
+				coalesce("Locations"."name", ''), "DocCache"."mealtime"
+			FROM "DocCache"
+			LEFT JOIN "Locations" ON "Locations"."id" = "DocCache"."location"
+			WHERE "DocCache"."day" BETWEEN $1 AND $2
+			ORDER BY "DocCache"."day", "DocCache"."mealtime", "Locations"."name"`,
+		from.Format(time.DateOnly), to.Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetUpcomingFavorites: failed db query: %v", err)
+	}
+	defer rows.Close()
+
+	// Rows come out chronologically, so meals end up ordered by when they
+	// first appear.
+	favorites := []UpcomingFavorite{}
+	mealIndex := make(map[string]int)
+	for rows.Next() {
+		var meal string
+		var mealtime int16
+		var occurrence MealOccurrence
+		err = rows.Scan(&meal, &occurrence.MealId, &occurrence.Day, &occurrence.Location, &occurrence.LocationName, &mealtime)
+		if err != nil {
+			return nil, fmt.Errorf("GetUpcomingFavorites: failed reading row: %v", err)
+		}
+
+		item := matcher.Item{
+			Name:     meal,
+			ID:       occurrence.MealId,
+			Location: occurrence.Location,
+			Mealtime: mealtime,
+		}
+		if !prefs.Match(item) {
+			continue
+		}
+		occurrence.Mealtime = periodNumToName(int(mealtime))
+
+		i, ok := mealIndex[meal]
+		if !ok {
+			i = len(favorites)
+			mealIndex[meal] = i
+			favorites = append(favorites, UpcomingFavorite{Meal: meal})
+		}
+		favorites[i].Occurrences = append(favorites[i].Occurrences, occurrence)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetUpcomingFavorites: failed reading rows: %v", err)
+	}
+
+	return favorites, nil
+}
+
+// How similar a meal name has to be to a search query to match when the
+// query isn't a substring of it. See word_similarity and the <% operator in
+// pg_trgm.
+const SEARCH_SIMILARITY_THRESHOLD = 0.5
+
+// Escapes the LIKE wildcards in s so it only matches itself.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Searches the names of every cached meal for query, case-insensitively and
+// tolerating typos. Meals containing query come first, then the rest by how
+// closely they match. Returns a page of matching meals with everywhere they're
+// served, along with the total number of matching meals.
+func SearchCacheMeals(db *pgxpool.Pool, query string, limit int, offset int) ([]SearchResult, int, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, 0, fmt.Errorf("SearchCacheMeals: failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// Both ILIKE and <% can use "DocCache_meal_trgm_idx", unlike comparing
+	// word_similarity() to a threshold. <% takes its threshold from a setting
+	// instead, which is set for just this transaction.
+	_, err = tx.Exec(
+		context.Background(),
+		`SELECT set_config('pg_trgm.word_similarity_threshold', $1, true)`,
+		fmt.Sprint(SEARCH_SIMILARITY_THRESHOLD),
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("SearchCacheMeals: failed to set similarity threshold: %v", err)
+	}
+
+	rows, err := tx.Query(
+		context.Background(),
+		`WITH "matches" AS (
+			SELECT "meal",
+					bool_or("meal" ILIKE '%' || $2 || '%') AS "contains",
+					word_similarity($1, "meal") AS "score",
+					count(*) OVER () AS "total"
+				FROM "DocCache"
+				WHERE "meal" ILIKE '%' || $2 || '%' OR $1 <% "meal"
+				GROUP BY "meal"
+				ORDER BY "contains" DESC, "score" DESC, "meal"
+				LIMIT $3 OFFSET $4
+		)
+		SELECT "matches"."meal", "matches"."total", "DocCache"."mealid", "DocCache"."day"::text,
+				"DocCache"."location", coalesce("Locations"."name", ''), "DocCache"."mealtime"
+			FROM "matches"
+			JOIN "DocCache" ON "DocCache"."meal" = "matches"."meal"
+			LEFT JOIN "Locations" ON "Locations"."id" = "DocCache"."location"
+			ORDER BY "matches"."contains" DESC, "matches"."score" DESC, "matches"."meal",
+				"DocCache"."day", "DocCache"."mealtime", "Locations"."name"`,
+		query, likeEscaper.Replace(query), limit, offset,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("SearchCacheMeals: failed db query: %v", err)
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	total := 0
+	for rows.Next() {
+		var meal string
+		var mealtime int
+		var occurrence MealOccurrence
+		err = rows.Scan(&meal, &total, &occurrence.MealId, &occurrence.Day, &occurrence.Location, &occurrence.LocationName, &mealtime)
+		if err != nil {
+			return nil, 0, fmt.Errorf("SearchCacheMeals: failed reading row: %v", err)
+		}
+		occurrence.Mealtime = periodNumToName(mealtime)
+
+		// Rows are grouped by meal, so a new meal starts a new result.
+		if len(results) == 0 || results[len(results)-1].Meal != meal {
+			results = append(results, SearchResult{Meal: meal})
+		}
+		last := &results[len(results)-1]
+		last.Occurrences = append(last.Occurrences, occurrence)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("SearchCacheMeals: failed reading rows: %v", err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return nil, 0, fmt.Errorf("SearchCacheMeals: failed to commit: %v", err)
+	}
+
+	return results, total, nil
+}
+
+// Gets a matcher for every one of a user's preference rules.
+func GetUserMatcher(db *pgxpool.Pool, uid int) (*matcher.Matcher, error) {
 	prefRows, err := db.Query(
 		context.Background(),
-		`SELECT "preference" FROM "Preferences" WHERE "user"=$1`,
+		`SELECT "preference", "matchType", "location", "mealtime"
+			FROM "Preferences"
+			WHERE "user"=$1`,
 		uid,
 	)
-	if errors.Is(err, pgx.ErrNoRows) {
-		return prefs, nil
-	} else if err != nil {
-		return nil, fmt.Errorf("GetUserPrefs: failed database query: %v", err)
+	if err != nil {
+		return nil, fmt.Errorf("GetUserMatcher: failed database query: %v", err)
 	}
 	defer prefRows.Close()
 
+	var rules []matcher.Rule
 	for prefRows.Next() {
-		var pref string
-		err = prefRows.Scan(&pref)
+		var rule matcher.Rule
+		err = prefRows.Scan(&rule.Pattern, &rule.Type, &rule.Location, &rule.Mealtime)
 		if err != nil {
-			return nil, fmt.Errorf("GetUserPrefs: failed reading row: %v", err)
+			return nil, fmt.Errorf("GetUserMatcher: failed reading row: %v", err)
 		}
-
-		prefs[pref] = true
+		rules = append(rules, rule)
+	}
+	if err = prefRows.Err(); err != nil {
+		return nil, fmt.Errorf("GetUserMatcher: failed reading rows: %v", err)
 	}
 
-	return prefs, err
+	return matcher.Compile(rules)
 }
 
 // Hashes a password using bcrypt.
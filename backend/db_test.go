@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The tables schema.sql builds on, with the columns the project uses.
+const testBaseSchema = `
+CREATE TABLE "Users" (
+	"id" serial PRIMARY KEY,
+	"email" text NOT NULL,
+	"password" bytea NOT NULL,
+	"displayName" text NOT NULL
+);
+CREATE TABLE "Preferences" (
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"preference" text NOT NULL
+);
+CREATE TABLE "DocCache" (
+	"day" date NOT NULL,
+	"location" text NOT NULL,
+	"mealtime" smallint NOT NULL,
+	"meal" text NOT NULL,
+	"mealid" text NOT NULL
+);
+`
+
+// Connects to the postgres database in TEST_DATABASE_URL, with schema.sql
+// loaded on top of testBaseSchema into a schema of its own that is dropped when the test ends. Skips
+// the test if TEST_DATABASE_URL isn't set.
+func newTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	ctx := context.Background()
+
+	conStr := os.Getenv("TEST_DATABASE_URL")
+	if conStr == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatalf("failed to name test schema: %v", err)
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+
+	admin, err := pgxpool.New(ctx, conStr)
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	t.Cleanup(admin.Close)
+	if _, err = admin.Exec(ctx, `CREATE SCHEMA "`+schema+`"`); err != nil {
+		t.Fatalf("failed to create test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(context.Background(), `DROP SCHEMA "`+schema+`" CASCADE`)
+	})
+
+	config, err := pgxpool.ParseConfig(conStr)
+	if err != nil {
+		t.Fatalf("invalid TEST_DATABASE_URL: %v", err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	db, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	schemaSql, err := os.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatalf("failed to read schema.sql: %v", err)
+	}
+	if _, err = db.Exec(ctx, testBaseSchema+string(schemaSql)); err != nil {
+		t.Fatalf("failed to load schema.sql: %v", err)
+	}
+
+	return db
+}
+
+// Makes a key set with a fresh Ed25519 signing key.
+func newTestKeySet(t *testing.T) *KeySet {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwt_current.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	t.Setenv("JWT_SIGNING_KEY", path)
+	t.Setenv("JWT_PREVIOUS_KEYS", "")
+	keys, err := loadKeySetFromEnv()
+	if err != nil {
+		t.Fatalf("loadKeySetFromEnv: %v", err)
+	}
+	return keys
+}
+
+func TestGetByEmailIgnoresCase(t *testing.T) {
+	db := newTestDB(t)
+
+	uid, err := AddNewUser(db, "Foo@x.edu", []byte("hash"), "Foo")
+	if err != nil {
+		t.Fatalf("AddNewUser: %v", err)
+	}
+
+	for _, email := range []string{"Foo@x.edu", "foo@x.edu", "FOO@X.EDU"} {
+		user, err := GetByEmail(db, email)
+		if err != nil {
+			t.Fatalf("GetByEmail(%q): %v", email, err)
+		}
+		if user == nil || user.ID != uid || user.Email != "Foo@x.edu" {
+			t.Errorf("GetByEmail(%q) = %+v, want user %d with their email as given at signup", email, user, uid)
+		}
+	}
+
+	if _, err = AddNewUser(db, "fOO@x.edu", []byte("hash"), "Foo"); !errors.Is(err, ErrEmailInUse) {
+		t.Errorf("AddNewUser with the email in another case = %v, want ErrEmailInUse", err)
+	}
+}
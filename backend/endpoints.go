@@ -4,30 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
-	"strconv"
+	"strings"
 	"time"
 
+	docclient "github.com/david-callender/FoodFinder/utils/dineocclient"
+	"github.com/david-callender/FoodFinder/utils/matcher"
 	"github.com/gin-gonic/gin"
 )
 
 func (s *Server) GetMenu(c *gin.Context) {
 	//Method: GET
 
-	accessToken := c.Query("accessToken")
+	uid := authedUser(c)
 	day := c.Query("day")
 	dining_hall := c.Query("diningHall")
 	mealtime := c.Query("mealtime")
 
-	uid, err := s.protectRoute(accessToken)
-
-	if err != nil {
-		fmt.Println("/getMenu: not authenticated: ", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"detail": "unauthenticated"})
-		return
-	}
-
 	// GetCacheMenu requires a time.Time so we have to parse the day
 	day_as_time, err := time.Parse(time.DateOnly, day)
 	if err != nil {
@@ -36,13 +30,42 @@ func (s *Server) GetMenu(c *gin.Context) {
 		return
 	}
 
-	menu, err := GetCacheMenu(s.DB, dining_hall, mealtime, day_as_time)
+	hall_exists, err := LocationsExist(s.DB, []string{dining_hall})
+	if err != nil {
+		fmt.Println("/getMenu: failed checking dining hall: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	} else if !hall_exists {
+		fmt.Println("/getMenu: received unknown dining hall")
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid dining hall"})
+		return
+	}
+
+	menu, err := GetCacheMenu(c.Request.Context(), s.DB, s.Dineoc, dining_hall, mealtime, day_as_time)
 	if errors.Is(err, ErrInvalidPeriodName) {
 		fmt.Println("/getMenu: received invalid period name")
 		c.JSON(
 			http.StatusBadRequest,
 			gin.H{"detail": "invalid period name"},
 		)
+		return
+	} else if errors.Is(err, docclient.ErrNotFound) {
+		fmt.Println("/getMenu: menu not found upstream: ", err)
+		c.JSON(
+			http.StatusNotFound,
+			gin.H{"detail": "menu not found"},
+		)
+		return
+	} else if errors.Is(err, docclient.ErrUpstream) ||
+		errors.Is(err, docclient.ErrRateLimitWait) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, new(net.Error)) {
+		fmt.Println("/getMenu: dineoncampus unavailable: ", err)
+		c.JSON(
+			http.StatusServiceUnavailable,
+			gin.H{"detail": "menu source unavailable"},
+		)
+		return
 	} else if err != nil {
 		fmt.Println("/getMenu: failed getting menu data: ", err)
 		c.JSON(
@@ -52,7 +75,7 @@ func (s *Server) GetMenu(c *gin.Context) {
 		return
 	}
 
-	userPrefs, err := GetUserPrefs(s.DB, uid)
+	prefs, err := GetUserMatcher(s.DB, uid)
 	if err != nil {
 		fmt.Println("/getMenu: failed getting user preferences: ", err)
 		c.JSON(
@@ -63,77 +86,235 @@ func (s *Server) GetMenu(c *gin.Context) {
 	}
 
 	for i := range menu {
-		menu[i].IsPreferred = userPrefs[menu[i].Meal]
+		menu[i].IsPreferred = prefs.Match(matcher.Item{
+			Name:     menu[i].Meal,
+			ID:       menu[i].Id,
+			Location: dining_hall,
+			Mealtime: int16(periodNameToNum[mealtime]),
+		})
+	}
+
+	err = fillRatings(s.DB, menu)
+	if err != nil {
+		fmt.Println("/getMenu: failed getting ratings: ", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"detail": "failed getting ratings"},
+		)
+		return
 	}
 
 	c.JSON(http.StatusOK, menu)
 }
 
-func (s *Server) addFoodPreference(c *gin.Context) {
-	var foodPreference struct {
-		AccessToken string `json:"accessToken" binding:"required"`
-		Meal        string `json:"meal" binding:"required"`
+// The most days /menus will return at once.
+const MAX_MENU_RANGE_DAYS = 14
+
+// Splits a comma separated query parameter into its values. Returns nil if the
+// parameter is missing or empty.
+func queryList(c *gin.Context, key string) []string {
+	var values []string
+	for _, value := range strings.Split(c.Query(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Method: GET
+func (s *Server) GetMenus(c *gin.Context) {
+	uid := authedUser(c)
+
+	from, err := time.Parse(time.DateOnly, c.Query("from"))
+	if err != nil {
+		fmt.Println("/menus: invalid from date: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid from date"})
+		return
+	}
+
+	to, err := time.Parse(time.DateOnly, c.Query("to"))
+	if err != nil {
+		fmt.Println("/menus: invalid to date: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid to date"})
+		return
+	}
+
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "to is before from"})
+		return
+	}
+
+	if to.Sub(from) >= MAX_MENU_RANGE_DAYS*24*time.Hour {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"detail": fmt.Sprintf("at most %d days may be requested", MAX_MENU_RANGE_DAYS)},
+		)
+		return
+	}
+
+	halls := queryList(c, "halls")
+	if halls != nil {
+		hallsExist, err := LocationsExist(s.DB, halls)
+		if err != nil {
+			fmt.Println("/menus: failed checking dining halls: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+			return
+		} else if !hallsExist {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid dining hall"})
+			return
+		}
+	}
+
+	mealtimes := queryList(c, "mealtimes")
+	if mealtimes == nil {
+		for name := range periodNameToNum {
+			mealtimes = append(mealtimes, name)
+		}
+	}
+
+	menus, err := GetCacheMenus(s.DB, from, to, halls, mealtimes)
+	if errors.Is(err, ErrInvalidPeriodName) {
+		fmt.Println("/menus: received invalid period name")
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid period name"})
+		return
+	} else if err != nil {
+		fmt.Println("/menus: failed getting menu data: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed getting menu data"})
+		return
+	}
+
+	prefs, err := GetUserMatcher(s.DB, uid)
+	if err != nil {
+		fmt.Println("/menus: failed getting user preferences: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed getting user preferences"})
+		return
+	}
+
+	var allMenus [][]MealWithPreference
+	for _, locations := range menus {
+		for location, periods := range locations {
+			for period, menu := range periods {
+				allMenus = append(allMenus, menu)
+				for i := range menu {
+					menu[i].IsPreferred = prefs.Match(matcher.Item{
+						Name:     menu[i].Meal,
+						ID:       menu[i].Id,
+						Location: location,
+						Mealtime: int16(periodNameToNum[period]),
+					})
+				}
+			}
+		}
+	}
+
+	err = fillRatings(s.DB, allMenus...)
+	if err != nil {
+		fmt.Println("/menus: failed getting ratings: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed getting ratings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, menus)
+}
+
+// The body of /addFoodPreference and /removeFoodPreference. Only meal is
+// required: rules default to exact matches at every location and mealtime.
+type foodPreferenceRequest struct {
+	Meal      string            `json:"meal" binding:"required"`
+	MatchType matcher.MatchType `json:"matchType"`
+	Location  *string           `json:"location"`
+	Mealtime  *string           `json:"mealtime"`
+}
+
+// Turns the request into the rule it describes. Returns an error if it
+// doesn't describe a valid rule.
+func (r foodPreferenceRequest) rule() (matcher.Rule, error) {
+	rule := matcher.Rule{Pattern: strings.TrimSpace(r.Meal), Type: r.MatchType, Location: r.Location}
+
+	if rule.Type == "" {
+		rule.Type = matcher.Exact
+	}
+
+	if r.Mealtime != nil {
+		num, ok := periodNameToNum[*r.Mealtime]
+		if !ok {
+			return rule, ErrInvalidPeriodName
+		}
+		mealtime := int16(num)
+		rule.Mealtime = &mealtime
 	}
 
+	return rule, matcher.Validate(rule)
+}
+
+func (s *Server) addFoodPreference(c *gin.Context) {
+	var foodPreference foodPreferenceRequest
+
+	id := authedUser(c)
 	err := c.ShouldBindJSON(&foodPreference)
 
 	if err != nil {
-		fmt.Println("/addFoodPreference: accessToken and meal required: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"detail": "accessToken and meal required"})
+		fmt.Println("/addFoodPreference: meal required: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "meal required"})
 		return
 	}
 
-	id, err := s.protectRoute(foodPreference.AccessToken)
+	rule, err := foodPreference.rule()
 
 	if err != nil {
-		fmt.Println("/addFoodPreference: not authenticated: ", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"detail": "unauthenticated"})
+		fmt.Println("/addFoodPreference: invalid rule: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
 
-	_, err = s.DB.Query(context.Background(), `INSERT INTO "Preferences" ("user", "preference") VALUES ($1, $2)`, id, foodPreference.Meal)
+	pref, created, err := AddPreference(s.DB, id, rule)
 
 	if err != nil {
-		fmt.Println("/addFoodPreference: failed in insert: ", err)
+		fmt.Println("/addFoodPreference: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
 		return
 	}
 
-	c.Status(http.StatusOK)
+	if created {
+		c.JSON(http.StatusCreated, pref)
+	} else {
+		c.JSON(http.StatusOK, pref)
+	}
 }
 
 func (s *Server) removeFoodPreference(c *gin.Context) {
-	var foodPreference struct {
-		AccessToken string `json:"accessToken" binding:"required"`
-		Meal        string `json:"meal" binding:"required"`
-	}
+	var foodPreference foodPreferenceRequest
 
+	id := authedUser(c)
 	err := c.ShouldBindJSON(&foodPreference)
 
 	if err != nil {
-		fmt.Println("/removeFoodPreference: accessToken and meal required: ", err)
-		c.JSON(http.StatusBadRequest, gin.H{"detail": "accessToken and meal required"})
+		fmt.Println("/removeFoodPreference: meal required: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "meal required"})
 		return
 	}
 
-	id, err := s.protectRoute(foodPreference.AccessToken)
+	rule, err := foodPreference.rule()
 
 	if err != nil {
-		fmt.Println("/addFoodPreference: not authenticated: ", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"detail": "unauthenticated"})
+		fmt.Println("/removeFoodPreference: invalid rule: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
 
-	_, err = s.DB.Query(context.Background(), `DELETE FROM "Preferences" WHERE "user" = $1 AND "preference" = $2`, id, foodPreference.Meal)
+	err = RemovePreference(s.DB, id, rule)
 
-	if err != nil {
-		fmt.Println("/addFoodPreference: failed in insert: ", err)
+	if errors.Is(err, ErrPreferenceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "preference not found"})
+		return
+	} else if err != nil {
+		fmt.Println("/removeFoodPreference: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
 		return
 	}
 
-	fmt.Println("removing preference: ", foodPreference.Meal)
-	c.Status(http.StatusOK)
+	c.Status(http.StatusNoContent)
 }
 
 //----------------------------------------------------
@@ -142,8 +323,6 @@ func (s *Server) removeFoodPreference(c *gin.Context) {
 
 // Method: POST
 func (s *Server) Refresh(c *gin.Context) {
-	jwt_refresh_key := []byte(os.Getenv("refresh_key"))
-
 	refresh_cookie, err := c.Cookie("refresh_token")
 
 	if err != nil {
@@ -152,31 +331,76 @@ func (s *Server) Refresh(c *gin.Context) {
 		return
 	}
 
-	token_data, err := verifyToken(refresh_cookie, jwt_refresh_key)
+	token_data, err := s.verifyToken(refresh_cookie, REFRESH_TOKEN_TYPE)
 	if err != nil {
 		fmt.Println("/refresh: token verification failed: ", err)
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "token verification failed"})
 		return
 	}
 
-	uid_str, err := token_data.GetSubject()
+	uid, session_id, err := tokenSession(token_data)
 
 	if err != nil {
-		fmt.Println(token_data)
-		fmt.Println("/refresh: no token subject: ", err)
+		fmt.Println("/refresh: invalid token payload: ", err)
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid token payload"})
 		return
 	}
 
-	uid, err := strconv.Atoi(uid_str)
+	err = s.checkSession(c.Request.Context(), uid, session_id)
 
 	if err != nil {
-		fmt.Println("/refresh: invalid token subject: ", err)
+		fmt.Println("/refresh: ", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "unauthenticated"})
+		return
+	}
+
+	refresh_id, ok := token_data["jti"].(string)
+
+	if !ok || refresh_id == "" {
+		fmt.Println("/refresh: no jti in refresh token")
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid token payload"})
 		return
 	}
 
-	access, err := RefreshCookieTemplate(c, uid)
+	new_refresh_id, err := newRandomId()
+
+	if err != nil {
+		fmt.Println("/refresh: token generation failed: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "token generation failed"})
+		return
+	}
+
+	new_refresh_id, err = s.Sessions.Rotate(
+		c.Request.Context(),
+		session_id,
+		refresh_id,
+		new_refresh_id,
+		time.Now().Add(REFRESH_TOKEN_KEEPALIVE),
+	)
+
+	if errors.Is(err, ErrRefreshTokenReused) {
+		// Someone presented a refresh token that was exchanged a while ago,
+		// so either it or its replacement is in the wrong hands. Kill the
+		// whole family so both copies stop working.
+		fmt.Println("/refresh: refresh token reused, revoking session ", session_id)
+		err = s.Sessions.Delete(c.Request.Context(), session_id)
+		if err != nil {
+			fmt.Println("/refresh: failed to revoke session: ", err)
+		}
+		clearRefreshCookie(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "unauthenticated"})
+		return
+	} else if errors.Is(err, ErrSessionNotFound) {
+		fmt.Println("/refresh: session not found")
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "unauthenticated"})
+		return
+	} else if err != nil {
+		fmt.Println("/refresh: failed to rotate refresh token: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	access, err := s.RefreshCookieTemplate(c, uid, session_id, new_refresh_id)
 
 	if err != nil {
 		fmt.Println("/refresh: token generation failed: ", err)
@@ -201,6 +425,16 @@ func (s *Server) Login(c *gin.Context) {
 		return
 	}
 
+	lockout, err := s.Logins.Locked(c.Request.Context(), login_account.Email)
+	if err != nil {
+		fmt.Println("/login: failed checking lockout: ", err)
+	}
+	if lockout > 0 {
+		fmt.Println("/login: account locked out")
+		abortTooManyRequests(c, lockout)
+		return
+	}
+
 	user_result, err := GetByEmail(s.DB, login_account.Email)
 	if err != nil {
 		fmt.Println("/login: database error getting user by email: ", err)
@@ -209,34 +443,51 @@ func (s *Server) Login(c *gin.Context) {
 	}
 	if user_result == nil {
 		fmt.Println("/login: user doesn't exist: ", err)
+		s.loginFailed(c, login_account.Email)
 		c.JSON(http.StatusUnauthorized, gin.H{"detail": "invalid credentials"})
 		return
 	}
 	err = CheckPasswordHash(user_result.Password, login_account.Password)
 	if err != nil {
 		fmt.Println("/login: invalid password: ", err)
+		s.loginFailed(c, login_account.Email)
 		c.JSON(http.StatusUnauthorized, gin.H{"detail": "invalid credentials"})
 		return
 	}
 
-	_, err = RefreshCookieTemplate(c, user_result.ID)
+	err = s.Logins.Succeeded(c.Request.Context(), login_account.Email)
+	if err != nil {
+		fmt.Println("/login: failed clearing login failures: ", err)
+	}
+
+	_, err = s.startSession(c, user_result.ID)
 
 	if err != nil {
-		fmt.Println("/login: token generation failed: ", err)
+		fmt.Println("/login: failed to start session: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "token generation failed"})
 		return
 	}
 
-	s.LoggedIn[user_result.ID] = true
-
 	c.JSON(http.StatusOK, gin.H{
 		"displayName": user_result.DisplayName,
 	})
 }
 
+// Records a failed login for progressive lockout. Unknown emails count too so
+// that lockouts don't reveal which emails have accounts.
+func (s *Server) loginFailed(c *gin.Context, email string) {
+	lockout, err := s.Logins.Failed(c.Request.Context(), email)
+	if err != nil {
+		fmt.Println("/login: failed recording login failure: ", err)
+		return
+	}
+	if lockout > 0 {
+		fmt.Println("/login: locking out account for ", lockout)
+	}
+}
+
 // Method: POST
 func (s *Server) Logout(c *gin.Context) {
-	jwt_refresh_key := []byte(os.Getenv("refresh_key"))
 	refresh_cookie, err := c.Cookie("refresh_token")
 
 	if err != nil {
@@ -245,7 +496,7 @@ func (s *Server) Logout(c *gin.Context) {
 		return
 	}
 
-	token_data, err := verifyToken(refresh_cookie, jwt_refresh_key)
+	token_data, err := s.verifyToken(refresh_cookie, REFRESH_TOKEN_TYPE)
 
 	if err != nil {
 		fmt.Println("/logout: invalid refresh token: ", err)
@@ -253,35 +504,23 @@ func (s *Server) Logout(c *gin.Context) {
 		return
 	}
 
-	subjectStr, err := token_data.GetSubject()
+	_, session_id, err := tokenSession(token_data)
 
 	if err != nil {
-		fmt.Println("/logout: no subject in refresh token: ", err)
+		fmt.Println("/logout: invalid token payload: ", err)
 		c.JSON(http.StatusUnauthorized, gin.H{"detail": "invalid jwt"})
 		return
 	}
 
-	subject, err := strconv.Atoi(subjectStr)
+	err = s.Sessions.Delete(c.Request.Context(), session_id)
 
 	if err != nil {
-		fmt.Println("/logout: invalid subject: ", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"detail": "invalid jwt"})
+		fmt.Println("/logout: failed to delete session: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
 		return
 	}
 
-	s.LoggedIn[subject] = false
-
-	newCookie := &http.Cookie{
-		Name:     "refresh_token",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1, // tells browser to delete
-		HttpOnly: true,
-		Secure:   false, // set true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
-	}
-
-	http.SetCookie(c.Writer, newCookie)
+	clearRefreshCookie(c)
 
 	c.Status(http.StatusOK)
 }
@@ -319,15 +558,21 @@ func (s *Server) Signup(c *gin.Context) {
 		return
 	}
 
-	_, err = RefreshCookieTemplate(c, uid)
+	// A failed verification email shouldn't fail the signup, since the user
+	// can ask for another one from /verify/resend.
+	err = s.sendVerificationEmail(uid, email, register_account.DisplayName)
 
 	if err != nil {
-		fmt.Println("/signup: token generation failed: ", err)
+		fmt.Println("/signup: failed to send verification email: ", err)
+	}
+
+	_, err = s.startSession(c, uid)
+
+	if err != nil {
+		fmt.Println("/signup: failed to start session: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "token generation failed"})
 		return
 	}
 
-	s.LoggedIn[uid] = true
-
 	c.Status(http.StatusCreated)
 }
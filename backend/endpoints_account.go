@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Users who log in through SSO have no password to confirm account changes
+// with. Instead, their current session must have been started by an SSO login
+// this recently.
+const OIDC_REAUTH_WINDOW = time.Minute * 10
+
+var ErrPasswordRequired = errors.New("current password required")
+var ErrInvalidCredentials = errors.New("invalid credentials")
+var ErrReauthRequired = errors.New("recent sso login required")
+
+// Checks that the user making an account change on a session is who they say
+// they are. Users with a password have to give it as currentPassword. Users
+// without one have to have logged in through SSO on the session less than
+// OIDC_REAUTH_WINDOW ago, which they can do again at /auth/oidc/start.
+func (s *Server) reauthenticate(ctx context.Context, user *User, sessionId string, currentPassword string) error {
+	if len(user.Password) != 0 {
+		if currentPassword == "" {
+			return ErrPasswordRequired
+		}
+		if CheckPasswordHash(user.Password, currentPassword) != nil {
+			return ErrInvalidCredentials
+		}
+		return nil
+	}
+
+	session, err := s.Sessions.Get(ctx, sessionId)
+
+	if errors.Is(err, ErrSessionNotFound) {
+		return ErrReauthRequired
+	} else if err != nil {
+		return err
+	}
+
+	if session.UserID != user.ID || time.Since(session.CreatedAt) > OIDC_REAUTH_WINDOW {
+		return ErrReauthRequired
+	}
+	return nil
+}
+
+// Responds to a request that failed reauthenticate with err.
+func abortReauth(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrPasswordRequired):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"detail": "currentPassword required"})
+	case errors.Is(err, ErrInvalidCredentials):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"detail": "invalid credentials"})
+	case errors.Is(err, ErrReauthRequired):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"detail":    "recent sso login required",
+			"reauthUrl": "/auth/oidc/start",
+		})
+	default:
+		fmt.Println(c.FullPath()+": failed to reauthenticate: ", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+	}
+}
+
+// Method: PATCH
+func (s *Server) UpdateAccount(c *gin.Context) {
+	var accountUpdate struct {
+		CurrentPassword string  `json:"currentPassword"`
+		Email           *string `json:"email"`
+		DisplayName     *string `json:"displayName"`
+		NewPassword     *string `json:"newPassword"`
+	}
+
+	uid := authedUser(c)
+	currentSession := authedSession(c)
+	err := c.ShouldBindJSON(&accountUpdate)
+
+	// Users without a password have nothing to send, so an empty body is
+	// fine.
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Println("/account: invalid body: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid body"})
+		return
+	}
+
+	user, err := GetById(s.DB, uid)
+
+	if err != nil || user == nil {
+		fmt.Println("/account: failed getting user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	err = s.reauthenticate(c.Request.Context(), user, currentSession, accountUpdate.CurrentPassword)
+
+	if err != nil {
+		fmt.Println("/account: reauthentication failed: ", err)
+		abortReauth(c, err)
+		return
+	}
+
+	if (accountUpdate.Email != nil && *accountUpdate.Email == "") ||
+		(accountUpdate.DisplayName != nil && *accountUpdate.DisplayName == "") ||
+		(accountUpdate.NewPassword != nil && *accountUpdate.NewPassword == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "fields may not be empty"})
+		return
+	}
+
+	// Only treat the email as changed if it actually is, so that resubmitting
+	// the current address doesn't unverify it.
+	emailChanged := accountUpdate.Email != nil && *accountUpdate.Email != user.Email
+	if !emailChanged {
+		accountUpdate.Email = nil
+	}
+
+	var password []byte
+	if accountUpdate.NewPassword != nil {
+		password, err = HashPassword(*accountUpdate.NewPassword)
+
+		if err != nil {
+			fmt.Println("/account: failed to hash password: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid password"})
+			return
+		}
+	}
+
+	err = UpdateUser(s.DB, uid, accountUpdate.Email, accountUpdate.DisplayName, password)
+
+	if errors.Is(err, ErrEmailInUse) {
+		c.JSON(http.StatusConflict, gin.H{"detail": "email already in use"})
+		return
+	} else if err != nil {
+		fmt.Println("/account: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	if accountUpdate.DisplayName != nil {
+		user.DisplayName = *accountUpdate.DisplayName
+	}
+
+	if emailChanged {
+		user.Email = *accountUpdate.Email
+		user.VerifiedAt = nil
+
+		err = s.sendVerificationEmail(uid, user.Email, user.DisplayName)
+
+		if err != nil {
+			fmt.Println("/account: failed to send verification email: ", err)
+		}
+	}
+
+	// A new password logs out every other device, in case the old one was
+	// known to someone else.
+	if password != nil {
+		sessions, err := s.Sessions.ListForUser(c.Request.Context(), uid)
+
+		if err != nil {
+			fmt.Println("/account: failed listing sessions: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+			return
+		}
+
+		for _, session := range sessions {
+			if session.ID == currentSession {
+				continue
+			}
+
+			err = s.Sessions.Delete(c.Request.Context(), session.ID)
+
+			if err != nil {
+				fmt.Println("/account: failed deleting session: ", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+				return
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"email":       user.Email,
+		"displayName": user.DisplayName,
+		"verified":    user.VerifiedAt != nil,
+	})
+}
+
+// Method: DELETE
+func (s *Server) DeleteAccount(c *gin.Context) {
+	var accountDelete struct {
+		CurrentPassword string `json:"currentPassword"`
+	}
+
+	uid := authedUser(c)
+	err := c.ShouldBindJSON(&accountDelete)
+
+	// Users without a password have nothing to send, so an empty body is
+	// fine.
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Println("/account: invalid body: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid body"})
+		return
+	}
+
+	user, err := GetById(s.DB, uid)
+
+	if err != nil || user == nil {
+		fmt.Println("/account: failed getting user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	err = s.reauthenticate(c.Request.Context(), user, authedSession(c), accountDelete.CurrentPassword)
+
+	if err != nil {
+		fmt.Println("/account: reauthentication failed: ", err)
+		abortReauth(c, err)
+		return
+	}
+
+	err = DeleteUser(s.DB, uid)
+
+	if err != nil {
+		fmt.Println("/account: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	// The database already dropped the user's sessions along with the user,
+	// but the session store may not be the database.
+	err = s.Sessions.DeleteForUser(c.Request.Context(), uid)
+
+	if err != nil {
+		fmt.Println("/account: failed to revoke sessions: ", err)
+	}
+
+	clearRefreshCookie(c)
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReauthenticateWithPassword(t *testing.T) {
+	ctx := context.Background()
+	s := &Server{Sessions: NewMemorySessionStore()}
+
+	hash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	user := &User{ID: 1, Password: hash}
+	session := newTestSession(t, s.Sessions.(*MemorySessionStore), "r0")
+
+	tests := []struct {
+		password string
+		want     error
+	}{
+		{"hunter2", nil},
+		{"", ErrPasswordRequired},
+		{"wrong", ErrInvalidCredentials},
+	}
+	for _, test := range tests {
+		err := s.reauthenticate(ctx, user, session.ID, test.password)
+		if !errors.Is(err, test.want) {
+			t.Errorf("reauthenticate(%q) = %v, want %v", test.password, err, test.want)
+		}
+	}
+}
+
+func TestReauthenticateWithoutPassword(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemorySessionStore()
+	s := &Server{Sessions: store}
+
+	// An SSO user has an empty password hash, which no password matches.
+	user := &User{ID: 1, Password: []byte{}}
+
+	recent := newTestSession(t, store, "r0")
+	if err := s.reauthenticate(ctx, user, recent.ID, ""); err != nil {
+		t.Errorf("reauthenticate on a fresh session = %v, want nil", err)
+	}
+	if err := s.reauthenticate(ctx, user, recent.ID, "anything"); err != nil {
+		t.Errorf("reauthenticate with a password on a fresh session = %v, want nil", err)
+	}
+
+	stale := newTestSession(t, store, "r0")
+	store.mu.Lock()
+	old := store.sessions[stale.ID]
+	old.CreatedAt = time.Now().Add(-OIDC_REAUTH_WINDOW - time.Minute)
+	store.sessions[stale.ID] = old
+	store.mu.Unlock()
+
+	if err := s.reauthenticate(ctx, user, stale.ID, ""); !errors.Is(err, ErrReauthRequired) {
+		t.Errorf("reauthenticate on a stale session = %v, want ErrReauthRequired", err)
+	}
+	if err := s.reauthenticate(ctx, user, "missing", ""); !errors.Is(err, ErrReauthRequired) {
+		t.Errorf("reauthenticate on a missing session = %v, want ErrReauthRequired", err)
+	}
+
+	someoneElse := &User{ID: 2, Password: []byte{}}
+	if err := s.reauthenticate(ctx, someoneElse, recent.ID, ""); !errors.Is(err, ErrReauthRequired) {
+		t.Errorf("reauthenticate on another user's session = %v, want ErrReauthRequired", err)
+	}
+}
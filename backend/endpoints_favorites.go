@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How many days /favorites/upcoming looks ahead by default, and at most. The
+// scraper only caches a couple of weeks ahead, so looking further is useless.
+const DEFAULT_UPCOMING_DAYS = 7
+const MAX_UPCOMING_DAYS = 14
+
+// Method: GET
+func (s *Server) GetUpcomingFavorites(c *gin.Context) {
+	uid := authedUser(c)
+
+	days := DEFAULT_UPCOMING_DAYS
+	if daysParam := c.Query("days"); daysParam != "" {
+		var err error
+		days, err = strconv.Atoi(daysParam)
+		if err != nil || days < 1 || days > MAX_UPCOMING_DAYS {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"detail": fmt.Sprintf("days must be between 1 and %d", MAX_UPCOMING_DAYS)},
+			)
+			return
+		}
+	}
+
+	today, err := time.Parse(time.DateOnly, time.Now().Format(time.DateOnly))
+	if err != nil {
+		fmt.Println("/favorites/upcoming: failed getting date: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed getting date"})
+		return
+	}
+
+	prefs, err := GetUserMatcher(s.DB, uid)
+	if err != nil {
+		fmt.Println("/favorites/upcoming: failed getting user preferences: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed getting user preferences"})
+		return
+	}
+
+	favorites, err := GetUpcomingFavorites(s.DB, prefs, today, today.AddDate(0, 0, days-1))
+	if err != nil {
+		fmt.Println("/favorites/upcoming: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, favorites)
+}
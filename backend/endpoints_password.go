@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/david-callender/FoodFinder/utils/mailer"
+	"github.com/gin-gonic/gin"
+)
+
+const PASSWORD_RESET_KEEPALIVE = time.Hour
+const PASSWORD_RESET_COOLDOWN = time.Minute * 2
+const PASSWORD_RESET_SUBJECT = "GopherGrub Password Reset"
+
+// Mails a user a password reset link, unless they were sent one less than
+// PASSWORD_RESET_COOLDOWN ago. Does nothing if no user has the email.
+func (s *Server) sendPasswordReset(email string) error {
+	user, err := GetByEmail(s.DB, email)
+
+	if err != nil {
+		return fmt.Errorf("database error getting user by email: %w", err)
+	}
+
+	if user == nil {
+		fmt.Println("/password/forgot: user doesn't exist")
+		return nil
+	}
+
+	last, err := LastPasswordReset(s.DB, user.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if time.Since(last) < PASSWORD_RESET_COOLDOWN {
+		fmt.Println("/password/forgot: reset email sent too recently")
+		return nil
+	}
+
+	token, err := newRandomId()
+
+	if err != nil {
+		return fmt.Errorf("token generation failed: %w", err)
+	}
+
+	err = AddPasswordReset(s.DB, user.ID, hashToken(token), time.Now().Add(PASSWORD_RESET_KEEPALIVE))
+
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("FRONTEND_URL") + "/reset-password?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hi %s,\n\nSomeone asked to reset your GopherGrub password. If it was you, "+
+			"follow the link below within the next hour to choose a new one:\n\n%s\n\n"+
+			"If it wasn't you, you can safely ignore this email.\n",
+		user.DisplayName,
+		link,
+	)
+
+	message, err := mailer.NewMessage(user.Email, PASSWORD_RESET_SUBJECT, body)
+
+	if err != nil {
+		return fmt.Errorf("failed to build email: %w", err)
+	}
+
+	return s.Mailer.Send(message)
+}
+
+// Method: POST
+func (s *Server) ForgotPassword(c *gin.Context) {
+	var forgotRequest struct {
+		Email string `json:"email" binding:"required"`
+	}
+
+	err := c.ShouldBindJSON(&forgotRequest)
+
+	if err != nil {
+		fmt.Println("/password/forgot: email required: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "email required"})
+		return
+	}
+
+	// We answer the same way and just as quickly whether or not the account
+	// exists, or was sent a link too recently, so this endpoint can't be used
+	// to find out who has signed up. Everything past here happens after the
+	// response.
+	go func() {
+		if err := s.sendPasswordReset(forgotRequest.Email); err != nil {
+			fmt.Println("/password/forgot: ", err)
+		}
+	}()
+
+	c.Status(http.StatusAccepted)
+}
+
+// Method: POST
+func (s *Server) ResetPassword(c *gin.Context) {
+	var resetRequest struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	err := c.ShouldBindJSON(&resetRequest)
+
+	if err != nil {
+		fmt.Println("/password/reset: token and password required: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "token and password required"})
+		return
+	}
+
+	password, err := HashPassword(resetRequest.Password)
+
+	if err != nil {
+		fmt.Println("/password/reset: failed to hash password: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid password"})
+		return
+	}
+
+	uid, err := RedeemPasswordReset(s.DB, hashToken(resetRequest.Token), password)
+
+	if errors.Is(err, ErrInvalidResetToken) {
+		fmt.Println("/password/reset: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid or expired token"})
+		return
+	} else if err != nil {
+		fmt.Println("/password/reset: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	// Whoever knew the old password may still be logged in somewhere.
+	err = s.Sessions.DeleteForUser(c.Request.Context(), uid)
+
+	if err != nil {
+		fmt.Println("/password/reset: failed to revoke sessions: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	clearRefreshCookie(c)
+
+	c.Status(http.StatusNoContent)
+}
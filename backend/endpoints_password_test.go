@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/wneessen/go-mail"
+)
+
+// A mailer.Sender that keeps what it's asked to send.
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []*mail.Msg
+}
+
+func (f *fakeMailer) Send(messages ...*mail.Msg) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, messages...)
+	return nil
+}
+
+func TestSendPasswordResetCooldown(t *testing.T) {
+	t.Setenv("NOTIFIER_EMAIL", "noreply@x.edu")
+	db := newTestDB(t)
+	mailer := &fakeMailer{}
+	s := &Server{DB: db, Mailer: mailer}
+
+	if _, err := AddNewUser(db, "Foo@x.edu", []byte("hash"), "Foo"); err != nil {
+		t.Fatalf("AddNewUser: %v", err)
+	}
+
+	for _, email := range []string{"foo@x.edu", "Foo@x.edu", "nobody@x.edu"} {
+		if err := s.sendPasswordReset(email); err != nil {
+			t.Fatalf("sendPasswordReset(%q): %v", email, err)
+		}
+	}
+
+	if len(mailer.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(mailer.sent))
+	}
+	if to := mailer.sent[0].GetTo(); len(to) != 1 || to[0].Address != "Foo@x.edu" {
+		t.Errorf("reset email sent to %v, want the address the user signed up with", to)
+	}
+}
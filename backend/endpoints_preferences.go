@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/david-callender/FoodFinder/utils/matcher"
+	"github.com/gin-gonic/gin"
+)
+
+// The columns of a preferences CSV export, which imports expect as a header.
+var PREFERENCE_CSV_HEADER = []string{"meal", "matchType", "location", "mealtime"}
+
+var ErrTooManyPreferences = fmt.Errorf("at most %d preferences are allowed", MAX_PREFERENCES)
+
+// Largest preferences import accepted, which leaves room for MAX_PREFERENCES
+// preferences with the longest patterns even once they are JSON escaped.
+const MAX_PREFERENCES_BODY_SIZE = MAX_PREFERENCES * 2048
+
+// Method: GET
+func (s *Server) GetPreferences(c *gin.Context) {
+	uid := authedUser(c)
+
+	prefs, err := ListPreferences(s.DB, uid)
+	if err != nil {
+		fmt.Println("/preferences: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, prefs)
+}
+
+// Method: GET
+func (s *Server) ExportPreferences(c *gin.Context) {
+	uid := authedUser(c)
+	format := c.DefaultQuery("format", "json")
+
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "format must be json or csv"})
+		return
+	}
+
+	prefs, err := ListPreferences(s.DB, uid)
+	if err != nil {
+		fmt.Println("/preferences/export: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=preferences."+format)
+
+	if format == "json" {
+		c.JSON(http.StatusOK, prefs)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(PREFERENCE_CSV_HEADER)
+	for _, pref := range prefs {
+		var location, mealtime string
+		if pref.Location != nil {
+			location = *pref.Location
+		}
+		if pref.Mealtime != nil {
+			mealtime = *pref.Mealtime
+		}
+		writer.Write([]string{pref.Meal, string(pref.MatchType), location, mealtime})
+	}
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		fmt.Println("/preferences/export: failed writing csv: ", err)
+	}
+}
+
+// Method: PUT
+func (s *Server) ReplacePreferences(c *gin.Context) {
+	uid := authedUser(c)
+
+	var prefs []foodPreferenceRequest
+	var err error
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, MAX_PREFERENCES_BODY_SIZE)
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType == "text/csv" {
+		prefs, err = readPreferencesCSV(body)
+	} else {
+		err = json.NewDecoder(body).Decode(&prefs)
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, ErrTooManyPreferences) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"detail": err.Error()})
+		return
+	} else if errors.As(err, &maxBytesErr) {
+		fmt.Println("/preferences: body too large")
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"detail": "body too large"})
+		return
+	} else if err != nil {
+		fmt.Println("/preferences: invalid body: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "body must be a list of preferences"})
+		return
+	}
+
+	if len(prefs) > MAX_PREFERENCES {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"detail": ErrTooManyPreferences.Error()})
+		return
+	}
+
+	rules := make([]matcher.Rule, 0, len(prefs))
+	for i, pref := range prefs {
+		rule, err := pref.rule()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": fmt.Sprintf("preference %d: %v", i+1, err)})
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	err = ReplacePreferences(s.DB, uid, rules)
+	if err != nil {
+		fmt.Println("/preferences: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	result, err := ListPreferences(s.DB, uid)
+	if err != nil {
+		fmt.Println("/preferences: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// Reads preferences from a CSV file in the format ExportPreferences writes.
+// Empty location and mealtime cells mean the preference isn't scoped.
+func readPreferencesCSV(body io.Reader) ([]foodPreferenceRequest, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = len(PREFERENCE_CSV_HEADER)
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range PREFERENCE_CSV_HEADER {
+		if strings.TrimSpace(header[i]) != column {
+			return nil, errors.New("csv header must be " + strings.Join(PREFERENCE_CSV_HEADER, ","))
+		}
+	}
+
+	prefs := []foodPreferenceRequest{}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(prefs) == MAX_PREFERENCES {
+			return nil, ErrTooManyPreferences
+		}
+
+		pref := foodPreferenceRequest{Meal: record[0], MatchType: matcher.MatchType(record[1])}
+		if record[2] != "" {
+			pref.Location = &record[2]
+		}
+		if record[3] != "" {
+			pref.Mealtime = &record[3]
+		}
+		prefs = append(prefs, pref)
+	}
+
+	return prefs, nil
+}
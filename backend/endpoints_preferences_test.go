@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReplacePreferencesBodyTooLarge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &Server{}
+	router := gin.New()
+	router.PUT("/preferences", s.ReplacePreferences)
+
+	// One enormous pattern is still under MAX_PREFERENCES, so only the body
+	// size can stop it.
+	pattern := strings.Repeat("a", MAX_PREFERENCES_BODY_SIZE)
+	bodies := map[string]string{
+		"application/json": `[{"meal": "` + pattern + `"}]`,
+		"text/csv":         strings.Join(PREFERENCE_CSV_HEADER, ",") + "\n" + pattern + ",exact,,\n",
+	}
+
+	for contentType, body := range bodies {
+		req := httptest.NewRequest(http.MethodPut, "/preferences", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s import of %d bytes got %d, want 413", contentType, len(body), w.Code)
+		}
+	}
+}
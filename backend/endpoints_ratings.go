@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How many ratings GET /meals/:id/ratings returns per page by default, and at
+// most.
+const DEFAULT_RATINGS_LIMIT = 20
+const MAX_RATINGS_LIMIT = 100
+
+// Method: POST
+func (s *Server) RateMeal(c *gin.Context) {
+	var ratingBody struct {
+		Day      string `json:"day" binding:"required"`
+		Location string `json:"location" binding:"required"`
+		Mealtime string `json:"mealtime" binding:"required"`
+		Score    int    `json:"score" binding:"required,min=1,max=5"`
+		Comment  string `json:"comment"`
+	}
+
+	uid := authedUser(c)
+	err := c.ShouldBindJSON(&ratingBody)
+
+	if err != nil {
+		fmt.Println("/meals/:id/ratings: invalid json: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "day, location, mealtime and a score from 1 to 5 required"})
+		return
+	}
+
+	day, err := time.Parse(time.DateOnly, ratingBody.Day)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid date"})
+		return
+	}
+
+	// Nobody can have eaten a meal that hasn't been served yet.
+	if day.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "meal has not been served yet"})
+		return
+	}
+
+	mealtime, ok := periodNameToNum[ratingBody.Mealtime]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid period name"})
+		return
+	}
+
+	comment := strings.TrimSpace(ratingBody.Comment)
+	if utf8.RuneCountInString(comment) > MAX_RATING_COMMENT_LENGTH {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"detail": fmt.Sprintf("comment must be at most %d characters", MAX_RATING_COMMENT_LENGTH)},
+		)
+		return
+	}
+
+	rating, created, err := UpsertRating(
+		s.DB, uid, c.Param("id"), day, ratingBody.Location, int16(mealtime), ratingBody.Score, comment,
+	)
+
+	if errors.Is(err, ErrMealNotServed) {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "meal was not served then"})
+		return
+	} else if err != nil {
+		fmt.Println("/meals/:id/ratings: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	if created {
+		c.JSON(http.StatusCreated, rating)
+	} else {
+		c.JSON(http.StatusOK, rating)
+	}
+}
+
+// Method: GET
+func (s *Server) GetMealRatings(c *gin.Context) {
+	mealId := c.Param("id")
+
+	limit, err := queryInt(c, "limit", DEFAULT_RATINGS_LIMIT)
+	if err == nil && (limit < 1 || limit > MAX_RATINGS_LIMIT) {
+		err = fmt.Errorf("limit must be between 1 and %d", MAX_RATINGS_LIMIT)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	summaries, err := GetRatingSummaries(s.DB, []string{mealId})
+	if err != nil {
+		fmt.Println("/meals/:id/ratings: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	ratings, err := GetRatings(s.DB, mealId, limit, offset)
+	if err != nil {
+		fmt.Println("/meals/:id/ratings: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"summary": summaries[mealId], "ratings": ratings})
+}
+
+// Method: POST
+func (s *Server) FlagRating(c *gin.Context) {
+	var flagBody struct {
+		Reason string `json:"reason"`
+	}
+
+	uid := authedUser(c)
+
+	ratingId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "rating not found"})
+		return
+	}
+
+	// The reason is optional, so an empty body is fine.
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&flagBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid json"})
+			return
+		}
+	}
+
+	reason := strings.TrimSpace(flagBody.Reason)
+	if utf8.RuneCountInString(reason) > MAX_RATING_COMMENT_LENGTH {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"detail": fmt.Sprintf("reason must be at most %d characters", MAX_RATING_COMMENT_LENGTH)},
+		)
+		return
+	}
+
+	err = FlagRating(s.DB, uid, ratingId, reason)
+
+	if errors.Is(err, ErrRatingNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "rating not found"})
+		return
+	} else if err != nil {
+		fmt.Println("/ratings/:id/flag: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
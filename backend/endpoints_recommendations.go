@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Method: GET
+func (s *Server) GetRecommendations(c *gin.Context) {
+	uid := authedUser(c)
+
+	day, err := time.Parse(time.DateOnly, c.DefaultQuery("day", time.Now().Format(time.DateOnly)))
+	if err != nil {
+		fmt.Println("/recommendations: invalid date: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid date"})
+		return
+	}
+
+	prefs, err := GetUserMatcher(s.DB, uid)
+	if err != nil {
+		fmt.Println("/recommendations: failed getting user preferences: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed getting user preferences"})
+		return
+	}
+
+	recommendations, err := GetRecommendations(s.DB, uid, prefs, day)
+	if err != nil {
+		fmt.Println("/recommendations: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, recommendations)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/david-callender/FoodFinder/utils/matcher"
+	"github.com/gin-gonic/gin"
+)
+
+// How many meals /search returns per page by default, and at most.
+const DEFAULT_SEARCH_LIMIT = 20
+const MAX_SEARCH_LIMIT = 50
+
+// Longest query /search accepts. Anything longer isn't a meal name.
+const MAX_SEARCH_QUERY_LENGTH = 100
+
+// A meal matching a search, and everywhere it's served.
+type SearchResult struct {
+	Meal        string           `json:"meal"`
+	IsPreferred bool             `json:"isPreferred"`
+	Occurrences []MealOccurrence `json:"occurrences"`
+}
+
+// Reads an optional non-negative integer query parameter.
+func queryInt(c *gin.Context, key string, fallback int) (int, error) {
+	param := c.Query(key)
+	if param == "" {
+		return fallback, nil
+	}
+
+	value, err := strconv.Atoi(param)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	return value, nil
+}
+
+// Method: GET
+func (s *Server) SearchMeals(c *gin.Context) {
+	uid := authedUser(c)
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" || len(query) > MAX_SEARCH_QUERY_LENGTH {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"detail": fmt.Sprintf("q must be between 1 and %d characters", MAX_SEARCH_QUERY_LENGTH)},
+		)
+		return
+	}
+
+	limit, err := queryInt(c, "limit", DEFAULT_SEARCH_LIMIT)
+	if err == nil && (limit < 1 || limit > MAX_SEARCH_LIMIT) {
+		err = fmt.Errorf("limit must be between 1 and %d", MAX_SEARCH_LIMIT)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	results, total, err := SearchCacheMeals(s.DB, query, limit, offset)
+	if err != nil {
+		fmt.Println("/search: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	prefs, err := GetUserMatcher(s.DB, uid)
+	if err != nil {
+		fmt.Println("/search: failed getting user preferences: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed getting user preferences"})
+		return
+	}
+
+	// A scoped rule may only match some of a meal's occurrences, but that's
+	// still a meal the user likes.
+	for i, result := range results {
+		for _, occurrence := range result.Occurrences {
+			item := matcher.Item{
+				Name:     result.Meal,
+				ID:       occurrence.MealId,
+				Location: occurrence.Location,
+				Mealtime: int16(periodNameToNum[occurrence.Mealtime]),
+			}
+			if prefs.Match(item) {
+				results[i].IsPreferred = true
+				break
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"total": total, "results": results})
+}
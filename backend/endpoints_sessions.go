@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Method: GET
+func (s *Server) GetSessions(c *gin.Context) {
+	uid := authedUser(c)
+	currentSession := authedSession(c)
+
+	sessions, err := s.Sessions.ListForUser(c.Request.Context(), uid)
+
+	if err != nil {
+		fmt.Println("/sessions: failed listing sessions: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	type sessionWithCurrent struct {
+		Session
+		Current bool `json:"current"`
+	}
+
+	response := make([]sessionWithCurrent, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, sessionWithCurrent{
+			Session: session,
+			Current: session.ID == currentSession,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Method: DELETE
+func (s *Server) DeleteSession(c *gin.Context) {
+	uid := authedUser(c)
+	currentSession := authedSession(c)
+	sessionId := c.Param("id")
+
+	session, err := s.Sessions.Get(c.Request.Context(), sessionId)
+
+	// Sessions belonging to other users are reported as missing so their IDs
+	// can't be probed.
+	if errors.Is(err, ErrSessionNotFound) || (err == nil && session.UserID != uid) {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "session not found"})
+		return
+	} else if err != nil {
+		fmt.Println("/sessions/:id: failed getting session: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	err = s.Sessions.Delete(c.Request.Context(), session.ID)
+
+	if err != nil {
+		fmt.Println("/sessions/:id: failed deleting session: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	if session.ID == currentSession {
+		clearRefreshCookie(c)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Method: POST
+func (s *Server) RevokeAllSessions(c *gin.Context) {
+	uid := authedUser(c)
+
+	err := s.Sessions.DeleteForUser(c.Request.Context(), uid)
+
+	if err != nil {
+		fmt.Println("/sessions/revokeAll: failed deleting sessions: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	clearRefreshCookie(c)
+
+	c.Status(http.StatusNoContent)
+}
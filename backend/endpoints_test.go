@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginIgnoresEmailCase(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	s := &Server{
+		DB:       db,
+		Keys:     newTestKeySet(t),
+		Sessions: NewMemorySessionStore(),
+		Logins:   NewMemoryLoginGuard(),
+	}
+
+	hash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if _, err = AddNewUser(db, "Foo@x.edu", hash, "Foo"); err != nil {
+		t.Fatalf("AddNewUser: %v", err)
+	}
+
+	router := gin.New()
+	router.POST("/login", s.Login)
+
+	for _, email := range []string{"Foo@x.edu", "foo@x.edu", "FOO@X.EDU"} {
+		body := `{"email": "` + email + `", "password": "hunter2"}`
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("login as %q got %d: %s", email, w.Code, w.Body)
+		}
+	}
+}
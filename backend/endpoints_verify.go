@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/david-callender/FoodFinder/utils/mailer"
+	"github.com/gin-gonic/gin"
+)
+
+const EMAIL_VERIFICATION_KEEPALIVE = time.Hour * 24 * 3
+const EMAIL_VERIFICATION_COOLDOWN = time.Minute * 2
+const EMAIL_VERIFICATION_SUBJECT = "Verify your GopherGrub email"
+
+// Creates a verification token for a user's email address and mails them a
+// link to redeem it. The email itself is sent in the background.
+func (s *Server) sendVerificationEmail(uid int, email string, displayName string) error {
+	token, err := newRandomId()
+
+	if err != nil {
+		return err
+	}
+
+	err = AddEmailVerification(s.DB, uid, email, hashToken(token), time.Now().Add(EMAIL_VERIFICATION_KEEPALIVE))
+
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("FRONTEND_URL") + "/verify?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hi %s,\n\nPlease confirm that this is your email address by following "+
+			"the link below. We won't send you any meal notifications until you do.\n\n%s\n",
+		displayName,
+		link,
+	)
+
+	message, err := mailer.NewMessage(email, EMAIL_VERIFICATION_SUBJECT, body)
+
+	if err != nil {
+		return fmt.Errorf("failed to build verification email: %w", err)
+	}
+
+	go func() {
+		if err := s.Mailer.Send(message); err != nil {
+			fmt.Println("failed to send verification email: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// Method: GET
+func (s *Server) VerifyEmail(c *gin.Context) {
+	token := c.Query("token")
+
+	if token == "" {
+		fmt.Println("/verify: no token")
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "token required"})
+		return
+	}
+
+	_, err := RedeemEmailVerification(s.DB, hashToken(token))
+
+	if errors.Is(err, ErrInvalidVerifyToken) {
+		fmt.Println("/verify: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid or expired token"})
+		return
+	} else if err != nil {
+		fmt.Println("/verify: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Method: POST
+func (s *Server) ResendVerification(c *gin.Context) {
+	uid := authedUser(c)
+
+	user, err := GetById(s.DB, uid)
+
+	if err != nil || user == nil {
+		fmt.Println("/verify/resend: failed getting user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	if user.VerifiedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"detail": "email already verified"})
+		return
+	}
+
+	last, err := LastEmailVerification(s.DB, uid)
+
+	if err != nil {
+		fmt.Println("/verify/resend: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	if wait := time.Until(last.Add(EMAIL_VERIFICATION_COOLDOWN)); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"detail": "verification email sent too recently"})
+		return
+	}
+
+	err = s.sendVerificationEmail(uid, user.Email, user.DisplayName)
+
+	if err != nil {
+		fmt.Println("/verify/resend: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed to send email"})
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
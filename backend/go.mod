@@ -5,13 +5,17 @@ go 1.25.1
 replace github.com/david-callender/FoodFinder/utils => ../utils
 
 require (
+	github.com/coreos/go-oidc/v3 v3.16.0
 	github.com/david-callender/FoodFinder/utils v0.0.0-00010101000000-000000000000
 	github.com/gin-contrib/cors v1.7.6
 	github.com/gin-gonic/gin v1.11.0
+	github.com/go-jose/go-jose/v4 v4.1.3
 	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/jackc/pgx/v5 v5.7.6
 	github.com/joho/godotenv v1.5.1
+	github.com/wneessen/go-mail v0.7.2
 	golang.org/x/crypto v0.42.0
+	golang.org/x/oauth2 v0.32.0
 )
 
 require (
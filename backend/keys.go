@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrNoSigningKey = errors.New("JWT_SIGNING_KEY is not set, cannot sign tokens")
+var ErrUnknownKey = errors.New("token signed with unknown key")
+
+// A key that tokens are signed or verified with. Ed25519 keys sign with EdDSA
+// and RSA keys with RS256. Id is the key's RFC 7638 thumbprint, which goes in
+// the "kid" header of tokens it signs.
+type SigningKey struct {
+	Id      string
+	Method  jwt.SigningMethod
+	Public  crypto.PublicKey
+	Private crypto.Signer // nil for keys that can only verify
+}
+
+// The keys tokens are signed and verified with. New tokens are signed with
+// Current. Tokens signed with any of the Previous keys are still accepted, so
+// keys can be rolled by moving the current key to the previous keys and
+// adding a new current key. A previous key can be dropped once every token it
+// signed has expired, which is REFRESH_TOKEN_KEEPALIVE after it stopped being
+// current.
+type KeySet struct {
+	Current  SigningKey
+	Previous []SigningKey
+}
+
+// Loads the key set from PEM files. JWT_SIGNING_KEY is the path to the current
+// private key, and JWT_PREVIOUS_KEYS is an optional comma separated list of
+// paths to previous private or public keys.
+func loadKeySetFromEnv() (*KeySet, error) {
+	currentPath := os.Getenv("JWT_SIGNING_KEY")
+	if currentPath == "" {
+		return nil, ErrNoSigningKey
+	}
+
+	current, err := loadSigningKey(currentPath)
+	if err != nil {
+		return nil, err
+	}
+	if current.Private == nil {
+		return nil, fmt.Errorf("JWT_SIGNING_KEY %s is not a private key", currentPath)
+	}
+
+	keys := &KeySet{Current: current}
+
+	for _, path := range strings.Split(os.Getenv("JWT_PREVIOUS_KEYS"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		previous, err := loadSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys.Previous = append(keys.Previous, previous)
+	}
+
+	return keys, nil
+}
+
+// Reads a PKCS#8 private key or PKIX public key from a PEM file.
+func loadSigningKey(path string) (SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("%s is not a PEM file", path)
+	}
+
+	var key SigningKey
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return SigningKey{}, fmt.Errorf("failed to parse private key %s: %w", path, err)
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return SigningKey{}, fmt.Errorf("%s is not a signing key", path)
+		}
+		key.Private = signer
+		key.Public = signer.Public()
+	case "PUBLIC KEY":
+		key.Public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return SigningKey{}, fmt.Errorf("failed to parse public key %s: %w", path, err)
+		}
+	default:
+		return SigningKey{}, fmt.Errorf("%s has unsupported PEM type %s", path, block.Type)
+	}
+
+	switch key.Public.(type) {
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	default:
+		return SigningKey{}, fmt.Errorf("%s is not an Ed25519 or RSA key", path)
+	}
+
+	jwk := jose.JSONWebKey{Key: key.Public}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to compute key id for %s: %w", path, err)
+	}
+	key.Id = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	return key, nil
+}
+
+// Finds the key with the given ID among the current and previous keys.
+func (k *KeySet) Lookup(kid string) (SigningKey, error) {
+	if k.Current.Id == kid {
+		return k.Current, nil
+	}
+	for _, key := range k.Previous {
+		if key.Id == kid {
+			return key, nil
+		}
+	}
+	return SigningKey{}, ErrUnknownKey
+}
+
+// Signs claims with the current key.
+func (k *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Current.Method, claims)
+	token.Header["kid"] = k.Current.Id
+	return token.SignedString(k.Current.Private)
+}
+
+// The public halves of every key as a JSON Web Key Set.
+func (k *KeySet) JWKS() jose.JSONWebKeySet {
+	var set jose.JSONWebKeySet
+	for _, key := range append([]SigningKey{k.Current}, k.Previous...) {
+		set.Keys = append(set.Keys, jose.JSONWebKey{
+			Key:       key.Public,
+			KeyID:     key.Id,
+			Algorithm: key.Method.Alg(),
+			Use:       "sig",
+		})
+	}
+	return set
+}
+
+// Method: GET
+func (s *Server) GetJWKS(c *gin.Context) {
+	// Verifiers may cache this, but not for so long that they miss a new key.
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, s.Keys.JWKS())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A dining location as stored by the scraper in "Locations".
+type Location struct {
+	Id       string `json:"id"`
+	Building string `json:"building"`
+	Name     string `json:"name"`
+	Scraped  bool   `json:"scraped"`
+}
+
+// Gets every known dining location, ordered by building and then name.
+func GetLocations(db *pgxpool.Pool) ([]Location, error) {
+	rows, err := db.Query(context.Background(), `
+		SELECT "id", "building", "name", "scraped"
+			FROM "Locations"
+			ORDER BY "building", "name"`)
+	if err != nil {
+		return nil, fmt.Errorf("GetLocations: failed db query: %v", err)
+	}
+	defer rows.Close()
+
+	locations := []Location{}
+	for rows.Next() {
+		var location Location
+		err = rows.Scan(&location.Id, &location.Building, &location.Name, &location.Scraped)
+		if err != nil {
+			return nil, fmt.Errorf("GetLocations: failed reading row: %v", err)
+		}
+		locations = append(locations, location)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetLocations: failed reading rows: %v", err)
+	}
+
+	return locations, nil
+}
+
+// Returns whether every one of locationIds is a known dining location.
+func LocationsExist(db *pgxpool.Pool, locationIds []string) (bool, error) {
+	var known int
+	err := db.QueryRow(context.Background(),
+		`SELECT count(*) FROM "Locations" WHERE "id" = ANY($1)`,
+		locationIds,
+	).Scan(&known)
+	if err != nil {
+		return false, fmt.Errorf("LocationsExist: failed db query: %v", err)
+	}
+
+	// Duplicate IDs would make the count come up short.
+	unique := map[string]bool{}
+	for _, id := range locationIds {
+		unique[id] = true
+	}
+	return known == len(unique), nil
+}
+
+// Method: GET
+func (s *Server) GetLocations(c *gin.Context) {
+	locations, err := GetLocations(s.DB)
+	if err != nil {
+		fmt.Println("/locations: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	// Locations only change when the scraper runs.
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, locations)
+}
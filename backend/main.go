@@ -1,16 +1,42 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"time"
 
+	docclient "github.com/david-callender/FoodFinder/utils/dineocclient"
+	"github.com/david-callender/FoodFinder/utils/mailer"
 	"github.com/gin-contrib/cors"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
 
+// How long the backend waits on dineoncampus for a menu that isn't cached.
+const DINEOC_TIMEOUT = 10 * time.Second
+
+// Retries for a menu that isn't cached. A user is waiting, so they are few
+// and quick, and a long Retry-After is answered with a 503 instead.
+var DINEOC_RETRY_POLICY = docclient.RetryPolicy{
+	MaxAttempts: 2,
+	BaseDelay:   250 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+// How long a menu that isn't cached may take in all, including retries and
+// waiting for the rate limit. Past it the user gets a 503.
+const DINEOC_DEADLINE = 15 * time.Second
+
+// The backend's own budget for requests to dineoncampus, kept well below the
+// default so that a rush of cache misses can't get the server blocked.
+var DINEOC_RATE_LIMIT = docclient.RateLimit{Burst: 2, Every: 3 * time.Second}
+
+// Users looking at a day tend to ask for several of its mealtimes in a row,
+// and each cache miss would otherwise fetch the day's periods again.
+const DINEOC_PERIOD_CACHE_TTL = 5 * time.Minute
+
 func main() {
 	log.Println("starting")
 
@@ -33,28 +59,96 @@ func main() {
 
 	defer db.Close()
 
-	s := &Server{DB: db, LoggedIn: map[int]bool{}}
+	keys, err := loadKeySetFromEnv()
+	if err != nil {
+		log.Fatalln("failed to load jwt signing keys: ", err)
+		return
+	}
+
+	s := &Server{
+		DB:       db,
+		Keys:     keys,
+		Sessions: NewPgSessionStore(db),
+		Mailer:   mailer.SMTPSender{},
+		Logins:   newLoginGuard(db),
+		// A user is waiting on these, so don't let them hang for long.
+		Dineoc: docclient.NewClient(
+			docclient.WithTimeout(DINEOC_TIMEOUT),
+			docclient.WithRetry(DINEOC_RETRY_POLICY),
+			docclient.WithRateLimit(DINEOC_RATE_LIMIT),
+			docclient.WithPeriodCache(DINEOC_PERIOD_CACHE_TTL),
+			docclient.WithLogger(log.Default()),
+		),
+	}
+
+	oidcProvider, err := newOIDCProviderFromEnv(context.Background())
+	if err != nil {
+		log.Fatalln("failed to set up oidc: ", err)
+		return
+	}
+	s.OIDC = oidcProvider
 
 	router := gin.Default()
+	if err := router.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		log.Fatalln("invalid TRUSTED_PROXIES: ", err)
+		return
+	}
 
 	corsOrigin := os.Getenv("CORS_ORIGIN");
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{corsOrigin}, // Next.js origin
-		AllowMethods:     []string{"POST", "GET", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
+		AllowMethods:     []string{"POST", "GET", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
-	router.POST("/refresh", s.Refresh)
-	router.POST("/signup", s.Signup)
-	router.POST("/login", s.Login)
+	loginLimiter := newRateLimiter(db, "login", LOGIN_RATE_LIMIT)
+	signupLimiter := newRateLimiter(db, "signup", SIGNUP_RATE_LIMIT)
+	refreshLimiter := newRateLimiter(db, "refresh", REFRESH_RATE_LIMIT)
+	forgotPasswordLimiter := newRateLimiter(db, "forgotPassword", FORGOT_PASSWORD_RATE_LIMIT)
+	resetPasswordLimiter := newRateLimiter(db, "resetPassword", RESET_PASSWORD_RATE_LIMIT)
+
+	router.GET("/.well-known/jwks.json", s.GetJWKS)
+	router.POST("/refresh", s.rateLimit(refreshLimiter), s.Refresh)
+	router.POST("/signup", s.rateLimit(signupLimiter), s.Signup)
+	router.POST("/login", s.rateLimit(loginLimiter), s.Login)
 	router.POST("/logout", s.Logout)
-	router.GET("/getMenu", s.GetMenu)
-	router.POST("/addFoodPreference", s.addFoodPreference)
-	router.POST("/removeFoodPreference", s.removeFoodPreference)
+	router.POST("/password/forgot", s.rateLimit(forgotPasswordLimiter), s.ForgotPassword)
+	router.POST("/password/reset", s.rateLimit(resetPasswordLimiter), s.ResetPassword)
+	router.GET("/verify", s.VerifyEmail)
+	router.GET("/locations", s.GetLocations)
+
+	if s.OIDC != nil {
+		router.GET("/auth/oidc/start", s.StartOIDCLogin)
+		router.GET("/auth/oidc/callback", s.FinishOIDCLogin)
+	}
+
+	// Everything in this group requires an access token.
+	authed := router.Group("/", s.requireAuth)
+	authed.POST("/verify/resend", s.ResendVerification)
+	authed.PATCH("/account", s.UpdateAccount)
+	authed.DELETE("/account", s.DeleteAccount)
+	authed.GET("/getMenu", s.GetMenu)
+	authed.GET("/menus", s.GetMenus)
+	authed.GET("/favorites/upcoming", s.GetUpcomingFavorites)
+	authed.GET("/search", s.SearchMeals)
+	authed.GET("/recommendations", s.GetRecommendations)
+	authed.POST("/addFoodPreference", s.addFoodPreference)
+	authed.POST("/removeFoodPreference", s.removeFoodPreference)
+	authed.GET("/preferences", s.GetPreferences)
+	authed.PUT("/preferences", s.ReplacePreferences)
+	authed.GET("/preferences/export", s.ExportPreferences)
+	authed.GET("/meals/resolve", s.ResolveMeal)
+	authed.GET("/meals/:id/names", s.GetMealNames)
+	authed.GET("/meals/:id/ratings", s.GetMealRatings)
+	authed.POST("/meals/:id/ratings", s.RateMeal)
+	authed.POST("/ratings/:id/flag", s.FlagRating)
+	authed.GET("/sessions", s.GetSessions)
+	authed.DELETE("/sessions/:id", s.DeleteSession)
+	authed.POST("/sessions/revokeAll", s.RevokeAllSessions)
 
 	hostname := os.Getenv("HOST_ADDR")
 
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/david-callender/FoodFinder/utils/matcher"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A name a meal has been served under, and the first and last days it was.
+type MealName struct {
+	Name      string `json:"name"`
+	FirstSeen string `json:"firstSeen"`
+	LastSeen  string `json:"lastSeen"`
+}
+
+// A dineoncampus meal ID and every name it has had, most recent first.
+type MealHistory struct {
+	Id    string     `json:"id"`
+	Names []MealName `json:"names"`
+}
+
+// Gets the name history of every meal that has gone by name, ignoring case and
+// extra whitespace. More than one meal can share a name, such as the same dish
+// at different halls. Meals that have most recently used the name come first.
+func ResolveMealName(db *pgxpool.Pool, name string) ([]MealHistory, error) {
+	rows, err := db.Query(
+		context.Background(),
+		`SELECT "MealNames"."mealId", "name", "firstSeen"::text, "lastSeen"::text
+			FROM "MealNames"
+			JOIN (
+				SELECT "mealId", max("lastSeen") AS "latest"
+					FROM "MealNames"
+					WHERE "nameKey" = $1
+					GROUP BY "mealId"
+			) AS "matches" ON "matches"."mealId" = "MealNames"."mealId"
+			ORDER BY "matches"."latest" DESC, "MealNames"."mealId", "lastSeen" DESC`,
+		matcher.Normalize(name),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ResolveMealName: failed db query: %v", err)
+	}
+	return scanMealHistories(rows)
+}
+
+// Gets the name history of a meal. The history has no names if the scraper has
+// never seen the meal.
+func GetMealHistory(db *pgxpool.Pool, id string) (MealHistory, error) {
+	rows, err := db.Query(
+		context.Background(),
+		`SELECT "mealId", "name", "firstSeen"::text, "lastSeen"::text
+			FROM "MealNames"
+			WHERE "mealId" = $1
+			ORDER BY "lastSeen" DESC`,
+		id,
+	)
+	if err != nil {
+		return MealHistory{}, fmt.Errorf("GetMealHistory: failed db query: %v", err)
+	}
+
+	histories, err := scanMealHistories(rows)
+	if err != nil || len(histories) == 0 {
+		return MealHistory{Id: id, Names: []MealName{}}, err
+	}
+	return histories[0], nil
+}
+
+// Reads rows of "mealId", "name", "firstSeen" and "lastSeen", grouped by meal,
+// into histories. Closes rows.
+func scanMealHistories(rows pgx.Rows) ([]MealHistory, error) {
+	defer rows.Close()
+
+	histories := []MealHistory{}
+	for rows.Next() {
+		var id string
+		var name MealName
+		err := rows.Scan(&id, &name.Name, &name.FirstSeen, &name.LastSeen)
+		if err != nil {
+			return nil, fmt.Errorf("scanMealHistories: failed reading row: %v", err)
+		}
+
+		if len(histories) == 0 || histories[len(histories)-1].Id != id {
+			histories = append(histories, MealHistory{Id: id})
+		}
+		last := &histories[len(histories)-1]
+		last.Names = append(last.Names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scanMealHistories: failed reading rows: %v", err)
+	}
+
+	return histories, nil
+}
+
+// Sets the DisplayName of every ID preference to the name its meal was last
+// served under.
+func fillDisplayNames(db *pgxpool.Pool, prefs []Preference) error {
+	var ids []string
+	for _, pref := range prefs {
+		if pref.MatchType == matcher.ID {
+			ids = append(ids, pref.Meal)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(
+		context.Background(),
+		`SELECT DISTINCT ON ("mealId") "mealId", "name"
+			FROM "MealNames"
+			WHERE "mealId" = ANY($1)
+			ORDER BY "mealId", "lastSeen" DESC`,
+		ids,
+	)
+	if err != nil {
+		return fmt.Errorf("fillDisplayNames: failed db query: %v", err)
+	}
+	defer rows.Close()
+
+	names := make(map[string]string)
+	for rows.Next() {
+		var id, name string
+		if err = rows.Scan(&id, &name); err != nil {
+			return fmt.Errorf("fillDisplayNames: failed reading row: %v", err)
+		}
+		names[id] = name
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("fillDisplayNames: failed reading rows: %v", err)
+	}
+
+	for i := range prefs {
+		if name, ok := names[prefs[i].Meal]; ok && prefs[i].MatchType == matcher.ID {
+			prefs[i].DisplayName = &name
+		}
+	}
+	return nil
+}
+
+// Method: GET
+func (s *Server) ResolveMeal(c *gin.Context) {
+	name := c.Query("name")
+
+	if strings.TrimSpace(name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "name required"})
+		return
+	}
+
+	histories, err := ResolveMealName(s.DB, name)
+	if err != nil {
+		fmt.Println("/meals/resolve: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, histories)
+}
+
+// Method: GET
+func (s *Server) GetMealNames(c *gin.Context) {
+	history, err := GetMealHistory(s.DB, c.Param("id"))
+	if err != nil {
+		fmt.Println("/meals/:id/names: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	if len(history.Names) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "meal not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
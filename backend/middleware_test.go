@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A request body that counts how much of it has been read.
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+func newBodyContext(body io.Reader) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", body)
+	return c
+}
+
+func TestDeprecatedAccessTokenFromBody(t *testing.T) {
+	body := `{"accessToken": "token", "meal": "Orange Chicken"}`
+	c := newBodyContext(strings.NewReader(body))
+
+	if token := deprecatedAccessToken(c); token != "token" {
+		t.Errorf("deprecatedAccessToken = %q, want token", token)
+	}
+
+	rest, err := io.ReadAll(c.Request.Body)
+	if err != nil || string(rest) != body {
+		t.Errorf("body after deprecatedAccessToken = (%q, %v), want it unchanged", rest, err)
+	}
+}
+
+func TestDeprecatedAccessTokenLimitsBody(t *testing.T) {
+	body := `{"accessToken": "token", "padding": "` + strings.Repeat("a", 1<<20) + `"}`
+	reader := &countingReader{Reader: strings.NewReader(body)}
+	c := newBodyContext(reader)
+
+	if token := deprecatedAccessToken(c); token != "" {
+		t.Errorf("deprecatedAccessToken on an oversized body = %q, want none", token)
+	}
+	if reader.read > DEPRECATED_TOKEN_BODY_LIMIT+4096 {
+		t.Errorf("read %d bytes of the body, want at most about %d", reader.read, DEPRECATED_TOKEN_BODY_LIMIT)
+	}
+
+	// The handler still gets the whole body if it gets that far.
+	rest, err := io.ReadAll(c.Request.Body)
+	if err != nil || string(rest) != body {
+		t.Errorf("body after deprecatedAccessToken is %d bytes (%v), want %d", len(rest), err, len(body))
+	}
+}
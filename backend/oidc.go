@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/oauth2"
+)
+
+// How long a user has to finish logging in with the identity provider.
+const OIDC_LOGIN_KEEPALIVE = time.Minute * 10
+
+var ErrInvalidOIDCState = errors.New("invalid or expired oidc state")
+var ErrEmailNotVerified = errors.New("identity provider has not verified the email")
+var ErrNoIdToken = errors.New("no id_token in token response")
+var ErrNonceMismatch = errors.New("id_token nonce mismatch")
+
+// An OpenID Connect identity provider that users can log in with, such as the
+// university's SSO.
+type OIDCProvider struct {
+	Issuer   string
+	Verifier *oidc.IDTokenVerifier
+	Config   oauth2.Config
+}
+
+// Sets up the identity provider from the OIDC_ISSUER_URL, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL environment variables. The
+// provider's configuration is discovered from the issuer, so pointing
+// OIDC_ISSUER_URL at a local mock provider works for testing. Returns nil if
+// OIDC_ISSUER_URL isn't set.
+func newOIDCProviderFromEnv(ctx context.Context) (*OIDCProvider, error) {
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover oidc provider: %w", err)
+	}
+
+	clientId := os.Getenv("OIDC_CLIENT_ID")
+
+	return &OIDCProvider{
+		Issuer:   issuer,
+		Verifier: provider.Verifier(&oidc.Config{ClientID: clientId}),
+		Config: oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+	}, nil
+}
+
+// Who the identity provider says logged in.
+type OIDCIdentity struct {
+	Subject string
+	Email   string
+	Name    string
+}
+
+// Finishes a login the identity provider sent back to the callback with code:
+// redeems the code for tokens with the PKCE verifier, checks the ID token's
+// signature and nonce, and returns the identity it vouches for. Returns
+// ErrEmailNotVerified if the provider hasn't verified the user's email.
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, verifier string, nonce string) (OIDCIdentity, error) {
+	oauthToken, err := p.Config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return OIDCIdentity{}, fmt.Errorf("code exchange failed: %w", err)
+	}
+
+	rawIdToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		return OIDCIdentity{}, ErrNoIdToken
+	}
+
+	idToken, err := p.Verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return OIDCIdentity{}, fmt.Errorf("invalid id_token: %w", err)
+	}
+
+	if idToken.Nonce != nonce {
+		return OIDCIdentity{}, ErrNonceMismatch
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+
+	if err = idToken.Claims(&claims); err != nil {
+		return OIDCIdentity{}, fmt.Errorf("unusable claims: %w", err)
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return OIDCIdentity{}, ErrEmailNotVerified
+	}
+
+	return OIDCIdentity{Subject: idToken.Subject, Email: claims.Email, Name: claims.Name}, nil
+}
+
+// Remembers a login that was sent to the identity provider until it comes
+// back to the callback.
+func AddOIDCLogin(db *pgxpool.Pool, state string, nonce string, verifier string, expiresAt time.Time) error {
+	_, err := db.Exec(context.Background(), `
+		INSERT INTO "OidcLogins" ("stateHash", "nonce", "verifier", "expiresAt")
+		VALUES ($1, $2, $3, $4)`, hashToken(state), nonce, verifier, expiresAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to insert oidc login: %w", err)
+	}
+	return nil
+}
+
+// Looks up and forgets a login by its state. Returns its (nonce, verifier),
+// or ErrInvalidOIDCState if the state is unknown, expired or already used.
+func RedeemOIDCLogin(db *pgxpool.Pool, state string) (string, string, error) {
+	var nonce, verifier string
+	err := db.QueryRow(context.Background(), `
+		DELETE FROM "OidcLogins"
+			WHERE "stateHash"=$1 AND "expiresAt" > now()
+			RETURNING "nonce", "verifier"`, hashToken(state)).Scan(&nonce, &verifier)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", ErrInvalidOIDCState
+	} else if err != nil {
+		return "", "", fmt.Errorf("failed to redeem oidc login: %w", err)
+	}
+	return nonce, verifier, nil
+}
+
+// Finds the user linked to an identity at an identity provider. If there is
+// none, the identity is linked to the user with the same email, and if there
+// is no such user one is created. Users made this way have no password, and
+// are verified since the provider has already verified their email.
+//
+// A user with the same email who never verified it may not be who owns the
+// address, since anyone can sign up with any email. Their password is cleared
+// and their sessions revoked before the identity is linked, so that whoever
+// set the password can't get back in, and the returned bool is true so the
+// caller can revoke sessions the database doesn't hold as well.
+func LinkOIDCUser(db *pgxpool.Pool, issuer string, subject string, email string, displayName string) (int, bool, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return -1, false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var uid int
+	err = tx.QueryRow(context.Background(),
+		`SELECT "user" FROM "OidcIdentities" WHERE "issuer"=$1 AND "subject"=$2`,
+		issuer, subject,
+	).Scan(&uid)
+
+	if err == nil {
+		return uid, false, nil
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return -1, false, fmt.Errorf("failed to get oidc identity: %w", err)
+	}
+
+	var verified bool
+	err = tx.QueryRow(context.Background(), `
+		SELECT "id", "verifiedAt" IS NOT NULL
+			FROM "Users"
+			WHERE lower("email")=lower($1)
+			FOR UPDATE`, email).Scan(&uid, &verified)
+
+	tookOver := false
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = tx.QueryRow(context.Background(), `
+			INSERT INTO "Users" ("email", "password", "displayName", "verifiedAt")
+			VALUES ($1, $2, $3, now())
+			RETURNING "id"`, email, []byte{}, displayName).Scan(&uid)
+	} else if err == nil && !verified {
+		tookOver = true
+		_, err = tx.Exec(context.Background(),
+			`UPDATE "Users" SET "password"=$2, "verifiedAt"=now() WHERE "id"=$1`,
+			uid, []byte{})
+		if err == nil {
+			_, err = tx.Exec(context.Background(), `DELETE FROM "Sessions" WHERE "user"=$1`, uid)
+		}
+	}
+	if err != nil {
+		return -1, false, fmt.Errorf("failed to find or create user: %w", err)
+	}
+
+	_, err = tx.Exec(context.Background(), `
+		INSERT INTO "OidcIdentities" ("issuer", "subject", "user")
+		VALUES ($1, $2, $3)`, issuer, subject, uid)
+	if err != nil {
+		return -1, false, fmt.Errorf("failed to link oidc identity: %w", err)
+	}
+
+	if err = tx.Commit(context.Background()); err != nil {
+		return -1, false, err
+	}
+	return uid, tookOver, nil
+}
+
+// Method: GET
+func (s *Server) StartOIDCLogin(c *gin.Context) {
+	state, err := newRandomId()
+
+	if err != nil {
+		fmt.Println("/auth/oidc/start: state generation failed: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "token generation failed"})
+		return
+	}
+
+	nonce, err := newRandomId()
+
+	if err != nil {
+		fmt.Println("/auth/oidc/start: nonce generation failed: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "token generation failed"})
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	err = AddOIDCLogin(s.DB, state, nonce, verifier, time.Now().Add(OIDC_LOGIN_KEEPALIVE))
+
+	if err != nil {
+		fmt.Println("/auth/oidc/start: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	// The state is also kept in a cookie so that the callback only finishes
+	// logins started by the same browser.
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		Path:     "/auth/oidc",
+		MaxAge:   int(OIDC_LOGIN_KEEPALIVE.Seconds()),
+		HttpOnly: true,
+		Secure:   false, // set true in HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	c.Redirect(http.StatusFound, s.OIDC.Config.AuthCodeURL(
+		state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(verifier),
+	))
+}
+
+// Method: GET
+func (s *Server) FinishOIDCLogin(c *gin.Context) {
+	if providerErr := c.Query("error"); providerErr != "" {
+		fmt.Println("/auth/oidc/callback: provider returned error: ", providerErr, c.Query("error_description"))
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "login cancelled"})
+		return
+	}
+
+	state := c.Query("state")
+	stateCookie, err := c.Cookie("oidc_state")
+
+	if err != nil || state == "" || state != stateCookie {
+		fmt.Println("/auth/oidc/callback: state mismatch: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid state"})
+		return
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    "",
+		Path:     "/auth/oidc",
+		MaxAge:   -1, // tells browser to delete
+		HttpOnly: true,
+		Secure:   false, // set true in HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	nonce, verifier, err := RedeemOIDCLogin(s.DB, state)
+
+	if errors.Is(err, ErrInvalidOIDCState) {
+		fmt.Println("/auth/oidc/callback: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid state"})
+		return
+	} else if err != nil {
+		fmt.Println("/auth/oidc/callback: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	identity, err := s.OIDC.Exchange(c.Request.Context(), c.Query("code"), verifier, nonce)
+
+	if errors.Is(err, ErrEmailNotVerified) {
+		fmt.Println("/auth/oidc/callback: ", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "email not verified"})
+		return
+	} else if err != nil {
+		fmt.Println("/auth/oidc/callback: ", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "login failed"})
+		return
+	}
+
+	displayName := identity.Name
+	if displayName == "" {
+		displayName, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	uid, tookOver, err := LinkOIDCUser(s.DB, s.OIDC.Issuer, identity.Subject, identity.Email, displayName)
+
+	if err != nil {
+		fmt.Println("/auth/oidc/callback: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+		return
+	}
+
+	// LinkOIDCUser already dropped the sessions it could, but the session
+	// store may not be the database.
+	if tookOver {
+		err = s.Sessions.DeleteForUser(c.Request.Context(), uid)
+
+		if err != nil {
+			fmt.Println("/auth/oidc/callback: failed to revoke sessions: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "database error"})
+			return
+		}
+	}
+
+	_, err = s.startSession(c, uid)
+
+	if err != nil {
+		fmt.Println("/auth/oidc/callback: failed to start session: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "token generation failed"})
+		return
+	}
+
+	// The frontend picks up the access token through /refresh like it does
+	// after a normal login.
+	c.Redirect(http.StatusFound, os.Getenv("FRONTEND_URL")+"/menu")
+}
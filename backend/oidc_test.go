@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testClientId = "foodfinder"
+
+// A mock OpenID Connect provider. It hands out an ID token with claims for
+// code, as long as the token request also has verifier as its PKCE verifier.
+// The token is signed with the key the provider publishes unless signingKey
+// is set.
+type mockOIDCProvider struct {
+	*httptest.Server
+	code       string
+	verifier   string
+	claims     jwt.MapClaims
+	signingKey *rsa.PrivateKey
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	mock := &mockOIDCProvider{code: "code", verifier: "verifier"}
+	mux := http.NewServeMux()
+	mock.Server = httptest.NewServer(mux)
+	t.Cleanup(mock.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                mock.URL,
+			"authorization_endpoint":                mock.URL + "/authorize",
+			"token_endpoint":                        mock.URL + "/token",
+			"jwks_uri":                              mock.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != mock.code || r.FormValue("code_verifier") != mock.verifier {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, mock.claims)
+		token.Header["kid"] = "test"
+		signingKey := key
+		if mock.signingKey != nil {
+			signingKey = mock.signingKey
+		}
+		idToken, err := token.SignedString(signingKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	return mock
+}
+
+// The claims of an ID token for a verified student, for the given nonce.
+func (m *mockOIDCProvider) studentClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            m.URL,
+		"sub":            "student-1",
+		"aud":            testClientId,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          "student@example.edu",
+		"email_verified": true,
+		"name":           "Goldy Gopher",
+	}
+}
+
+func newTestOIDCProvider(t *testing.T, mock *mockOIDCProvider) *OIDCProvider {
+	t.Helper()
+
+	t.Setenv("OIDC_ISSUER_URL", mock.URL)
+	t.Setenv("OIDC_CLIENT_ID", testClientId)
+	t.Setenv("OIDC_CLIENT_SECRET", "secret")
+	t.Setenv("OIDC_REDIRECT_URL", "http://localhost:8080/auth/oidc/callback")
+
+	provider, err := newOIDCProviderFromEnv(context.Background())
+	if err != nil {
+		t.Fatalf("newOIDCProviderFromEnv: %v", err)
+	}
+	return provider
+}
+
+func TestNewOIDCProviderFromEnvUnset(t *testing.T) {
+	t.Setenv("OIDC_ISSUER_URL", "")
+
+	provider, err := newOIDCProviderFromEnv(context.Background())
+	if provider != nil || err != nil {
+		t.Errorf("newOIDCProviderFromEnv = (%v, %v), want (nil, nil)", provider, err)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider := newTestOIDCProvider(t, mock)
+	mock.claims = mock.studentClaims("nonce")
+
+	identity, err := provider.Exchange(context.Background(), mock.code, mock.verifier, "nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	want := OIDCIdentity{Subject: "student-1", Email: "student@example.edu", Name: "Goldy Gopher"}
+	if identity != want {
+		t.Errorf("Exchange = %+v, want %+v", identity, want)
+	}
+}
+
+func TestOIDCExchangeRejects(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider := newTestOIDCProvider(t, mock)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier string
+		nonce    string
+		claims   func(jwt.MapClaims)
+		key      *rsa.PrivateKey
+		want     error
+	}{
+		{name: "wrong verifier", verifier: "other"},
+		{name: "wrong nonce", nonce: "other", want: ErrNonceMismatch},
+		{name: "unverified email", claims: func(c jwt.MapClaims) { c["email_verified"] = false }, want: ErrEmailNotVerified},
+		{name: "no email", claims: func(c jwt.MapClaims) { delete(c, "email") }, want: ErrEmailNotVerified},
+		{name: "wrong audience", claims: func(c jwt.MapClaims) { c["aud"] = "someone-else" }},
+		{name: "expired", claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "wrong key", key: otherKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock.claims = mock.studentClaims("nonce")
+			if test.claims != nil {
+				test.claims(mock.claims)
+			}
+			mock.signingKey = test.key
+			verifier := mock.verifier
+			if test.verifier != "" {
+				verifier = test.verifier
+			}
+			nonce := "nonce"
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+
+			_, err := provider.Exchange(context.Background(), mock.code, verifier, nonce)
+			if err == nil {
+				t.Fatal("Exchange succeeded, want an error")
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("Exchange = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
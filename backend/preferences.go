@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/david-callender/FoodFinder/utils/matcher"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Most preferences a user may have. Bulk imports over this are rejected.
+const MAX_PREFERENCES = 500
+
+// How many days back ListPreferences looks for when a preference was last
+// served. The scraper keeps about this much of the past in the menu cache
+// anyway.
+const LAST_SERVED_WINDOW_DAYS = 7
+
+// A preference rule as the API shows it. Mealtime is a period name rather than
+// the number stored in the db.
+type Preference struct {
+	Meal       string            `json:"meal"`
+	MatchType  matcher.MatchType `json:"matchType"`
+	Location   *string           `json:"location"`
+	Mealtime   *string           `json:"mealtime"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	LastServed *string           `json:"lastServed"`
+	// The name an ID preference's meal was last served under.
+	DisplayName *string `json:"displayName,omitempty"`
+}
+
+var ErrPreferenceNotFound = errors.New("preference not found")
+
+// The key a rule's pattern is stored under in "mealKey". Two rules with the
+// same key, match type and scopes are the same preference. Regexes and IDs
+// are only trimmed, since folding them could change what they mean.
+func mealKey(rule matcher.Rule) string {
+	if rule.Type == matcher.Regex || rule.Type == matcher.ID {
+		return strings.TrimSpace(rule.Pattern)
+	}
+	return matcher.Normalize(rule.Pattern)
+}
+
+// Identifies a rule the same way the "Preferences" unique index does.
+type ruleKey struct {
+	mealKey   string
+	matchType matcher.MatchType
+	location  string
+	mealtime  int16
+}
+
+func keyOf(rule matcher.Rule) ruleKey {
+	key := ruleKey{mealKey: mealKey(rule), matchType: rule.Type, mealtime: -1}
+	if rule.Location != nil {
+		key.location = *rule.Location
+	}
+	if rule.Mealtime != nil {
+		key.mealtime = *rule.Mealtime
+	}
+	return key
+}
+
+// Reads a preference out of a row of "preference", "matchType", "location",
+// "mealtime" and "createdAt". Also returns the rule it describes.
+func scanPreference(row pgx.Row) (Preference, matcher.Rule, error) {
+	var pref Preference
+	var rule matcher.Rule
+
+	err := row.Scan(&rule.Pattern, &rule.Type, &rule.Location, &rule.Mealtime, &pref.CreatedAt)
+	if err != nil {
+		return pref, rule, err
+	}
+
+	pref.Meal = rule.Pattern
+	pref.MatchType = rule.Type
+	pref.Location = rule.Location
+	if rule.Mealtime != nil {
+		name := periodNumToName(int(*rule.Mealtime))
+		pref.Mealtime = &name
+	}
+	return pref, rule, nil
+}
+
+// Adds a preference for a user unless they already have it. Returns the
+// stored preference and whether it was newly added.
+func AddPreference(db *pgxpool.Pool, uid int, rule matcher.Rule) (Preference, bool, error) {
+	// The no-op update makes RETURNING give back the existing row on a
+	// conflict, and xmax is only 0 for rows this statement inserted.
+	var created bool
+	var pref Preference
+	var mealtime *int16
+	err := db.QueryRow(
+		context.Background(),
+		`INSERT INTO "Preferences" ("user", "preference", "mealKey", "matchType", "location", "mealtime")
+			VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT ("user", "mealKey", "matchType", (coalesce("location", '')), (coalesce("mealtime", -1)))
+			DO UPDATE SET "user"=excluded."user"
+		RETURNING "preference", "matchType", "location", "mealtime", "createdAt", xmax = 0`,
+		uid, rule.Pattern, mealKey(rule), string(rule.Type), rule.Location, rule.Mealtime,
+	).Scan(&pref.Meal, &pref.MatchType, &pref.Location, &mealtime, &pref.CreatedAt, &created)
+	if err != nil {
+		return pref, false, fmt.Errorf("AddPreference: failed upsert: %v", err)
+	}
+
+	if mealtime != nil {
+		name := periodNumToName(int(*mealtime))
+		pref.Mealtime = &name
+	}
+
+	prefs := []Preference{pref}
+	if err = fillDisplayNames(db, prefs); err != nil {
+		return pref, false, err
+	}
+	return prefs[0], created, nil
+}
+
+// Removes one of a user's preferences. Returns ErrPreferenceNotFound if they
+// don't have it.
+func RemovePreference(db *pgxpool.Pool, uid int, rule matcher.Rule) error {
+	tag, err := db.Exec(
+		context.Background(),
+		`DELETE FROM "Preferences"
+			WHERE "user"=$1 AND "mealKey"=$2 AND "matchType"=$3
+			AND coalesce("location", '')=coalesce($4, '') AND coalesce("mealtime", -1)=coalesce($5, -1)`,
+		uid, mealKey(rule), string(rule.Type), rule.Location, rule.Mealtime,
+	)
+	if err != nil {
+		return fmt.Errorf("RemovePreference: failed delete: %v", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrPreferenceNotFound
+	}
+	return nil
+}
+
+// Gets every one of a user's preferences, oldest first. LastServed is the last
+// day up to today that a meal matching the preference was served, if that was
+// in the last LAST_SERVED_WINDOW_DAYS days.
+func ListPreferences(db *pgxpool.Pool, uid int) ([]Preference, error) {
+	prefRows, err := db.Query(
+		context.Background(),
+		`SELECT "preference", "matchType", "location", "mealtime", "createdAt"
+			FROM "Preferences"
+			WHERE "user"=$1
+			ORDER BY "createdAt", "preference"`,
+		uid,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ListPreferences: failed db query: %v", err)
+	}
+	defer prefRows.Close()
+
+	prefs := []Preference{}
+	var rules []matcher.Rule
+	for prefRows.Next() {
+		pref, rule, err := scanPreference(prefRows)
+		if err != nil {
+			return nil, fmt.Errorf("ListPreferences: failed reading row: %v", err)
+		}
+		prefs = append(prefs, pref)
+		rules = append(rules, rule)
+	}
+	if err = prefRows.Err(); err != nil {
+		return nil, fmt.Errorf("ListPreferences: failed reading rows: %v", err)
+	}
+	prefRows.Close()
+
+	if len(prefs) == 0 {
+		return prefs, nil
+	}
+
+	// Each rule needs its own matcher to tell which of them matched.
+	matchers := make([]*matcher.Matcher, len(rules))
+	for i, rule := range rules {
+		matchers[i], err = matcher.Compile([]matcher.Rule{rule})
+		if err != nil {
+			// Rules are validated before they're stored, so this only
+			// happens if one was put in the db by hand.
+			fmt.Println("ListPreferences: skipping invalid rule: ", err)
+		}
+	}
+
+	// Only the recent past is looked at, so that every request doesn't run
+	// the whole cache through every rule.
+	today := time.Now()
+	servedRows, err := db.Query(
+		context.Background(),
+		`SELECT "meal", "mealid", "location", "mealtime", max("day")::text
+			FROM "DocCache"
+			WHERE "day" BETWEEN $1 AND $2
+			GROUP BY "meal", "mealid", "location", "mealtime"`,
+		today.AddDate(0, 0, -LAST_SERVED_WINDOW_DAYS).Format(time.DateOnly),
+		today.Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ListPreferences: failed db query: %v", err)
+	}
+	defer servedRows.Close()
+
+	for servedRows.Next() {
+		var item matcher.Item
+		var day string
+		err = servedRows.Scan(&item.Name, &item.ID, &item.Location, &item.Mealtime, &day)
+		if err != nil {
+			return nil, fmt.Errorf("ListPreferences: failed reading row: %v", err)
+		}
+		for i := range prefs {
+			// Dates are YYYY-MM-DD, so they compare correctly as strings.
+			if matchers[i].Match(item) && (prefs[i].LastServed == nil || *prefs[i].LastServed < day) {
+				lastServed := day
+				prefs[i].LastServed = &lastServed
+			}
+		}
+	}
+	if err = servedRows.Err(); err != nil {
+		return nil, fmt.Errorf("ListPreferences: failed reading rows: %v", err)
+	}
+
+	if err = fillDisplayNames(db, prefs); err != nil {
+		return nil, err
+	}
+
+	return prefs, nil
+}
+
+// Replaces all of a user's preferences with rules in a single transaction, so
+// a failed import leaves the old preferences untouched. Rules the user already
+// had keep their creation time, and rules with the same key are only stored
+// once.
+func ReplacePreferences(db *pgxpool.Pool, uid int, rules []matcher.Rule) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Locking the user stops two imports from interleaving. Locking their
+	// preferences wouldn't, since a user with none has nothing to lock.
+	_, err = tx.Exec(context.Background(), `SELECT 1 FROM "Users" WHERE "id"=$1 FOR UPDATE`, uid)
+	if err != nil {
+		return fmt.Errorf("ReplacePreferences: failed locking user: %v", err)
+	}
+
+	oldRows, err := tx.Query(
+		context.Background(),
+		`SELECT "preference", "matchType", "location", "mealtime", "createdAt"
+			FROM "Preferences"
+			WHERE "user"=$1`,
+		uid,
+	)
+	if err != nil {
+		return fmt.Errorf("ReplacePreferences: failed db query: %v", err)
+	}
+
+	createdAt := make(map[ruleKey]time.Time)
+	for oldRows.Next() {
+		var rule matcher.Rule
+		var created time.Time
+		err = oldRows.Scan(&rule.Pattern, &rule.Type, &rule.Location, &rule.Mealtime, &created)
+		if err != nil {
+			oldRows.Close()
+			return fmt.Errorf("ReplacePreferences: failed reading row: %v", err)
+		}
+		createdAt[keyOf(rule)] = created
+	}
+	oldRows.Close()
+	if err = oldRows.Err(); err != nil {
+		return fmt.Errorf("ReplacePreferences: failed reading rows: %v", err)
+	}
+
+	_, err = tx.Exec(context.Background(), `DELETE FROM "Preferences" WHERE "user"=$1`, uid)
+	if err != nil {
+		return fmt.Errorf("ReplacePreferences: failed deleting preferences: %v", err)
+	}
+
+	now := time.Now()
+	seen := make(map[ruleKey]bool)
+	var newRows [][]any
+	for _, rule := range rules {
+		key := keyOf(rule)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		created, ok := createdAt[key]
+		if !ok {
+			created = now
+		}
+		newRows = append(newRows, []any{
+			uid, rule.Pattern, key.mealKey, string(rule.Type), rule.Location, rule.Mealtime, created,
+		})
+	}
+
+	_, err = tx.CopyFrom(
+		context.Background(),
+		pgx.Identifier{"Preferences"},
+		[]string{"user", "preference", "mealKey", "matchType", "location", "mealtime", "createdAt"},
+		pgx.CopyFromRows(newRows),
+	)
+	if err != nil {
+		return fmt.Errorf("ReplacePreferences: failed inserting preferences: %v", err)
+	}
+
+	return tx.Commit(context.Background())
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A token bucket budget. A bucket holds up to Burst requests and gets one
+// back every Every.
+type RateLimit struct {
+	Burst int
+	Every time.Duration
+}
+
+// Per client IP budgets for the unauthenticated endpoints.
+var LOGIN_RATE_LIMIT = RateLimit{Burst: 10, Every: time.Second * 10}
+var SIGNUP_RATE_LIMIT = RateLimit{Burst: 5, Every: time.Minute * 5}
+
+// Every forgot password request may send an email, and every reset request
+// guesses at a token.
+var FORGOT_PASSWORD_RATE_LIMIT = RateLimit{Burst: 5, Every: time.Minute * 5}
+var RESET_PASSWORD_RATE_LIMIT = RateLimit{Burst: 10, Every: time.Minute}
+
+// The frontend refreshes before most requests, so this one is generous.
+var REFRESH_RATE_LIMIT = RateLimit{Burst: 60, Every: time.Second}
+
+// Logins for an email are locked out after LOGIN_LOCKOUT_THRESHOLD failures
+// in a row. The lockout starts at LOGIN_LOCKOUT_BASE and doubles with every
+// further failure up to LOGIN_LOCKOUT_MAX. Failures older than
+// LOGIN_FAILURE_WINDOW are forgotten.
+const LOGIN_LOCKOUT_THRESHOLD = 5
+const LOGIN_LOCKOUT_BASE = time.Second * 30
+const LOGIN_LOCKOUT_MAX = time.Hour
+const LOGIN_FAILURE_WINDOW = time.Hour
+
+// Takes requests out of token buckets identified by a key. Implementations
+// must be safe for concurrent use.
+type RateLimiter interface {
+	// Takes a request from key's bucket. Returns whether the request is
+	// allowed and, if it isn't, how long until it would be.
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+// Tracks failed logins per email for progressive lockout. Implementations
+// must be safe for concurrent use.
+type LoginGuard interface {
+	// Returns how much longer logins for email are locked out, or 0 if they
+	// aren't.
+	Locked(ctx context.Context, email string) (time.Duration, error)
+	// Records a failed login for email. Returns the lockout that failure
+	// caused, or 0 if it didn't cause one.
+	Failed(ctx context.Context, email string) (time.Duration, error)
+	// Forgets the failed logins for email.
+	Succeeded(ctx context.Context, email string) error
+}
+
+// Builds a rate limiter for a budget. Setting RATE_LIMIT_STORE=postgres keeps
+// the buckets in the database so they are shared between backend instances,
+// otherwise each instance keeps its own in memory.
+func newRateLimiter(db *pgxpool.Pool, name string, limit RateLimit) RateLimiter {
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		return &PgRateLimiter{DB: db, Name: name, Limit: limit}
+	}
+	return NewMemoryRateLimiter(limit)
+}
+
+// Like newRateLimiter, but for a LoginGuard.
+func newLoginGuard(db *pgxpool.Pool) LoginGuard {
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		return &PgLoginGuard{DB: db}
+	}
+	return NewMemoryLoginGuard()
+}
+
+// The proxies allowed to tell us a request's client IP with X-Forwarded-For,
+// from TRUSTED_PROXIES as a comma separated list of IPs or CIDRs. Anyone can
+// set the header, so requests from anywhere else are known by the address
+// they came from, or the per IP limits could be dodged by changing it.
+func trustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// Gin middleware that rejects requests with 429 once the client's IP has used
+// up its budget in limiter. The router must only trust the proxies from
+// trustedProxiesFromEnv.
+func (s *Server) rateLimit(limiter RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, wait, err := limiter.Allow(c.Request.Context(), c.ClientIP())
+
+		// A broken limiter shouldn't take the endpoint down with it.
+		if err != nil {
+			fmt.Println(c.FullPath()+": rate limiter failed: ", err)
+			c.Next()
+			return
+		}
+
+		if !allowed {
+			abortTooManyRequests(c, wait)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Responds with 429 and a Retry-After header telling the client to wait.
+func abortTooManyRequests(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"detail": "too many requests"})
+}
+
+// How long a login lockout lasts after a number of failures in a row.
+func lockoutFor(failures int) time.Duration {
+	if failures < LOGIN_LOCKOUT_THRESHOLD {
+		return 0
+	}
+
+	lockout := LOGIN_LOCKOUT_BASE
+	for i := LOGIN_LOCKOUT_THRESHOLD; i < failures && lockout < LOGIN_LOCKOUT_MAX; i++ {
+		lockout *= 2
+	}
+
+	return min(lockout, LOGIN_LOCKOUT_MAX)
+}
+
+// Emails are compared case-insensitively so lockouts can't be dodged by
+// changing case.
+func loginGuardKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// RateLimiter that keeps its buckets in memory.
+type MemoryRateLimiter struct {
+	Limit RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	// New buckets since the last sweep.
+	added int
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// Buckets are swept after this many new ones, so the map doesn't grow forever.
+// Counting new buckets rather than sweeping whenever the map is big keeps the
+// cost of a sweep spread over the requests that caused it, even when most
+// buckets are still in use.
+const memoryBucketSweepSize = 10000
+
+// The Postgres stores delete rows that no longer matter after every this many
+// requests.
+const PG_PRUNE_EVERY = 1000
+
+func NewMemoryRateLimiter(limit RateLimit) *MemoryRateLimiter {
+	return &MemoryRateLimiter{Limit: limit, buckets: map[string]*memoryBucket{}}
+}
+
+// Refills a bucket for the time since it was last updated.
+func (m *MemoryRateLimiter) refill(bucket *memoryBucket, now time.Time) {
+	elapsed := now.Sub(bucket.updatedAt)
+	bucket.tokens = min(float64(m.Limit.Burst), bucket.tokens+float64(elapsed)/float64(m.Limit.Every))
+	bucket.updatedAt = now
+}
+
+func (m *MemoryRateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	bucket, ok := m.buckets[key]
+	if !ok {
+		if m.added >= memoryBucketSweepSize {
+			// Full buckets behave exactly like missing ones, so they can go.
+			for k, bucket := range m.buckets {
+				m.refill(bucket, now)
+				if bucket.tokens >= float64(m.Limit.Burst) {
+					delete(m.buckets, k)
+				}
+			}
+			m.added = 0
+		}
+
+		bucket = &memoryBucket{tokens: float64(m.Limit.Burst), updatedAt: now}
+		m.buckets[key] = bucket
+		m.added++
+	}
+	m.refill(bucket, now)
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) * float64(m.Limit.Every))
+		return false, wait, nil
+	}
+
+	bucket.tokens--
+	return true, 0, nil
+}
+
+// RateLimiter that keeps its buckets in the "RateLimits" table. Name keeps
+// the buckets of different limiters apart.
+type PgRateLimiter struct {
+	DB    *pgxpool.Pool
+	Name  string
+	Limit RateLimit
+
+	calls atomic.Uint64
+}
+
+func (p *PgRateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	if p.calls.Add(1)%PG_PRUNE_EVERY == 0 {
+		go p.prune()
+	}
+
+	var allowed bool
+	var tokens float64
+
+	// The refill, the check and the withdrawal all happen in one statement,
+	// and the update sees the row as locked by ON CONFLICT, so concurrent
+	// requests from other instances can't overdraw the bucket.
+	err := p.DB.QueryRow(ctx, `
+		INSERT INTO "RateLimits" AS "r" ("key", "tokens", "allowed", "updatedAt")
+			VALUES ($1, $2::float8 - 1, true, now())
+		ON CONFLICT ("key") DO UPDATE SET
+			"tokens"=CASE
+				WHEN least($2::float8, "r"."tokens" + extract(epoch FROM now() - "r"."updatedAt") / $3::float8) >= 1
+				THEN least($2::float8, "r"."tokens" + extract(epoch FROM now() - "r"."updatedAt") / $3::float8) - 1
+				ELSE least($2::float8, "r"."tokens" + extract(epoch FROM now() - "r"."updatedAt") / $3::float8)
+			END,
+			"allowed"=least($2::float8, "r"."tokens" + extract(epoch FROM now() - "r"."updatedAt") / $3::float8) >= 1,
+			"updatedAt"=now()
+		RETURNING "tokens", "allowed"`,
+		p.Name+":"+key, float64(p.Limit.Burst), p.Limit.Every.Seconds(),
+	).Scan(&tokens, &allowed)
+
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to take from rate limit bucket: %w", err)
+	}
+
+	if !allowed {
+		wait := time.Duration((1 - tokens) * float64(p.Limit.Every))
+		return false, wait, nil
+	}
+	return true, 0, nil
+}
+
+// Deletes the limiter's buckets that have had time to fill back up, since
+// they behave exactly like missing ones.
+func (p *PgRateLimiter) prune() {
+	_, err := p.DB.Exec(context.Background(), `
+		DELETE FROM "RateLimits"
+			WHERE "updatedAt" < now() - $2::float8 * interval '1 second'
+			AND starts_with("key", $1)`,
+		p.Name+":", p.Limit.Every.Seconds()*float64(p.Limit.Burst),
+	)
+	if err != nil {
+		fmt.Println("failed to prune rate limit buckets: ", err)
+	}
+}
+
+// LoginGuard that keeps failed logins in memory. Like MemoryRateLimiter's
+// buckets, entries are swept after memoryBucketSweepSize new ones.
+type MemoryLoginGuard struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+	// New entries since the last sweep.
+	added int
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewMemoryLoginGuard() *MemoryLoginGuard {
+	return &MemoryLoginGuard{failures: map[string]*loginFailures{}}
+}
+
+func (m *MemoryLoginGuard) Locked(ctx context.Context, email string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures, ok := m.failures[loginGuardKey(email)]
+	if !ok {
+		return 0, nil
+	}
+	return max(time.Until(failures.lockedUntil), 0), nil
+}
+
+func (m *MemoryLoginGuard) Failed(ctx context.Context, email string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	key := loginGuardKey(email)
+
+	failures, ok := m.failures[key]
+	if !ok && m.added >= memoryBucketSweepSize {
+		// Entries whose lockout is over and whose failures would be forgotten
+		// anyway behave exactly like missing ones, so they can go.
+		for k, failures := range m.failures {
+			if now.After(failures.lockedUntil) && now.Sub(failures.lastFailure) > LOGIN_FAILURE_WINDOW {
+				delete(m.failures, k)
+			}
+		}
+		m.added = 0
+	}
+	if !ok {
+		m.added++
+	}
+	if !ok || now.Sub(failures.lastFailure) > LOGIN_FAILURE_WINDOW {
+		failures = &loginFailures{}
+		m.failures[key] = failures
+	}
+
+	failures.count++
+	failures.lastFailure = now
+
+	lockout := lockoutFor(failures.count)
+	failures.lockedUntil = now.Add(lockout)
+	return lockout, nil
+}
+
+func (m *MemoryLoginGuard) Succeeded(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.failures, loginGuardKey(email))
+	return nil
+}
+
+// LoginGuard that keeps failed logins in the "LoginFailures" table.
+type PgLoginGuard struct {
+	DB *pgxpool.Pool
+
+	calls atomic.Uint64
+}
+
+func (p *PgLoginGuard) Locked(ctx context.Context, email string) (time.Duration, error) {
+	var remaining float64
+	err := p.DB.QueryRow(ctx, `
+		SELECT coalesce(max(extract(epoch FROM "lockedUntil" - now())), 0)
+			FROM "LoginFailures"
+			WHERE "email"=$1`,
+		loginGuardKey(email),
+	).Scan(&remaining)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to check login lockout: %w", err)
+	}
+	return max(time.Duration(remaining*float64(time.Second)), 0), nil
+}
+
+func (p *PgLoginGuard) Failed(ctx context.Context, email string) (time.Duration, error) {
+	if p.calls.Add(1)%PG_PRUNE_EVERY == 0 {
+		go p.prune()
+	}
+
+	key := loginGuardKey(email)
+
+	var count int
+	err := p.DB.QueryRow(ctx, `
+		INSERT INTO "LoginFailures" ("email", "failures", "lastFailure")
+			VALUES ($1, 1, now())
+		ON CONFLICT ("email") DO UPDATE SET
+			"failures"=CASE
+				WHEN "LoginFailures"."lastFailure" < now() - $2::float8 * interval '1 second' THEN 1
+				ELSE "LoginFailures"."failures" + 1
+			END,
+			"lastFailure"=now()
+		RETURNING "failures"`,
+		key, LOGIN_FAILURE_WINDOW.Seconds(),
+	).Scan(&count)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to record login failure: %w", err)
+	}
+
+	lockout := lockoutFor(count)
+	if lockout == 0 {
+		return 0, nil
+	}
+
+	_, err = p.DB.Exec(ctx,
+		`UPDATE "LoginFailures" SET "lockedUntil"=now() + $2::float8 * interval '1 second' WHERE "email"=$1`,
+		key, lockout.Seconds(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock out login: %w", err)
+	}
+	return lockout, nil
+}
+
+func (p *PgLoginGuard) Succeeded(ctx context.Context, email string) error {
+	_, err := p.DB.Exec(ctx, `DELETE FROM "LoginFailures" WHERE "email"=$1`, loginGuardKey(email))
+	if err != nil {
+		return fmt.Errorf("failed to clear login failures: %w", err)
+	}
+	return nil
+}
+
+// Deletes the failed logins that would be forgotten anyway and no longer lock
+// anyone out.
+func (p *PgLoginGuard) prune() {
+	_, err := p.DB.Exec(context.Background(), `
+		DELETE FROM "LoginFailures"
+			WHERE "lastFailure" < now() - $1::float8 * interval '1 second'
+			AND ("lockedUntil" IS NULL OR "lockedUntil" < now())`,
+		LOGIN_FAILURE_WINDOW.Seconds(),
+	)
+	if err != nil {
+		fmt.Println("failed to prune login failures: ", err)
+	}
+}
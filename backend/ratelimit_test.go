@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMemoryLoginGuardSweeps(t *testing.T) {
+	ctx := context.Background()
+	guard := NewMemoryLoginGuard()
+
+	// Fill the guard with failures that are long forgotten, plus one that is
+	// still locked out.
+	old := time.Now().Add(-2 * LOGIN_FAILURE_WINDOW)
+	for i := 0; i < memoryBucketSweepSize-1; i++ {
+		guard.failures[strconv.Itoa(i)] = &loginFailures{count: 1, lastFailure: old, lockedUntil: old}
+	}
+	guard.failures["locked"] = &loginFailures{
+		count:       LOGIN_LOCKOUT_THRESHOLD,
+		lastFailure: old,
+		lockedUntil: time.Now().Add(time.Hour),
+	}
+	guard.added = len(guard.failures)
+
+	if _, err := guard.Failed(ctx, "new@example.com"); err != nil {
+		t.Fatalf("Failed: %v", err)
+	}
+
+	if len(guard.failures) != 2 {
+		t.Errorf("%d entries left after sweep, want 2", len(guard.failures))
+	}
+	if locked, _ := guard.Locked(ctx, "locked"); locked <= 0 {
+		t.Errorf("sweep dropped an entry that is still locked out")
+	}
+}
+
+func TestMemoryRateLimiterSweepsAfterNewBuckets(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewMemoryRateLimiter(RateLimit{Burst: 1, Every: time.Millisecond})
+
+	for i := 0; i < memoryBucketSweepSize; i++ {
+		if _, _, err := limiter.Allow(ctx, strconv.Itoa(i)); err != nil {
+			t.Fatalf("Allow: %v", err)
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// Requests from known clients don't sweep, however big the map is.
+	if _, _, err := limiter.Allow(ctx, "0"); err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	if len(limiter.buckets) != memoryBucketSweepSize {
+		t.Errorf("%d buckets after a known key, want %d", len(limiter.buckets), memoryBucketSweepSize)
+	}
+
+	// Every bucket but the one just used has filled back up.
+	if _, _, err := limiter.Allow(ctx, "new"); err != nil {
+		t.Fatalf("Allow: %v", err)
+	}
+	if len(limiter.buckets) != 2 {
+		t.Errorf("%d buckets after sweep, want 2", len(limiter.buckets))
+	}
+}
+
+// Sends requests to a rate limited route from remoteAddr, each claiming a
+// different X-Forwarded-For, and returns their statuses.
+func forwardedForStatuses(t *testing.T, remoteAddr string, n int) []int {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{}
+	router := gin.New()
+	if err := router.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		t.Fatalf("SetTrustedProxies: %v", err)
+	}
+	limiter := NewMemoryRateLimiter(RateLimit{Burst: 1, Every: time.Hour})
+	router.POST("/login", s.rateLimit(limiter), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	var statuses []int
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i+1))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		statuses = append(statuses, w.Code)
+	}
+	return statuses
+}
+
+func TestRateLimitIgnoresForgedForwardedFor(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "")
+
+	statuses := forwardedForStatuses(t, "203.0.113.7:5000", 3)
+	for i, status := range statuses[1:] {
+		if status != http.StatusTooManyRequests {
+			t.Errorf("request %d with a new X-Forwarded-For got %d, want 429", i+2, status)
+		}
+	}
+}
+
+func TestRateLimitTrustsConfiguredProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 203.0.113.7")
+
+	statuses := forwardedForStatuses(t, "203.0.113.7:5000", 3)
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("request %d for a new client through a trusted proxy got %d, want 200", i+1, status)
+		}
+	}
+}
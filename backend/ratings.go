@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Longest comment a rating may have.
+const MAX_RATING_COMMENT_LENGTH = 500
+
+// How many users have to flag a rating before it's hidden.
+const RATING_FLAG_HIDE_THRESHOLD = 3
+
+var ErrMealNotServed = errors.New("meal was not served then")
+var ErrRatingNotFound = errors.New("rating not found")
+
+// A user's rating of one occurrence of a meal.
+type Rating struct {
+	Id          int64     `json:"id"`
+	DisplayName string    `json:"displayName"`
+	Day         string    `json:"day"`
+	Location    string    `json:"location"`
+	Mealtime    string    `json:"mealtime"`
+	Score       int       `json:"score"`
+	Comment     string    `json:"comment"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// The aggregate of every visible rating of a meal. Distribution[i] is how many
+// ratings gave the meal i+1 out of 5.
+type RatingSummary struct {
+	Average      float64 `json:"average"`
+	Count        int     `json:"count"`
+	Distribution [5]int  `json:"distribution"`
+}
+
+// Stores a user's rating of a meal served at location during mealtime on day,
+// replacing the rating they already gave that occurrence if there is one.
+// Returns the stored rating and whether it was new. Returns ErrMealNotServed
+// if the menu cache has no such occurrence.
+func UpsertRating(db *pgxpool.Pool, uid int, mealId string, day time.Time, location string, mealtime int16, score int, comment string) (Rating, bool, error) {
+	var rating Rating
+	var created bool
+
+	dayFormatted := day.Format(time.DateOnly)
+	err := db.QueryRow(
+		context.Background(),
+		`WITH "occurrence" AS (
+			SELECT 1 FROM "DocCache"
+				WHERE "mealid"=$2 AND "day"=$3 AND "location"=$4 AND "mealtime"=$5
+				LIMIT 1
+		)
+		INSERT INTO "Ratings" AS "r" ("user", "mealId", "day", "location", "mealtime", "score", "comment")
+			SELECT $1, $2, $3, $4, $5, $6, $7 FROM "occurrence"
+		ON CONFLICT ("user", "mealId", "day", "location", "mealtime") DO UPDATE SET
+			"score"=excluded."score",
+			"comment"=excluded."comment",
+			"updatedAt"=now()
+		RETURNING "r"."id", (SELECT "displayName" FROM "Users" WHERE "id"=$1),
+			"r"."day"::text, "r"."location", "r"."score", "r"."comment",
+			"r"."createdAt", "r"."updatedAt", xmax = 0`,
+		uid, mealId, dayFormatted, location, mealtime, score, comment,
+	).Scan(
+		&rating.Id, &rating.DisplayName, &rating.Day, &rating.Location, &rating.Score,
+		&rating.Comment, &rating.CreatedAt, &rating.UpdatedAt, &created,
+	)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return rating, false, ErrMealNotServed
+	} else if err != nil {
+		return rating, false, fmt.Errorf("UpsertRating: failed upsert: %v", err)
+	}
+
+	rating.Mealtime = periodNumToName(int(mealtime))
+	return rating, created, nil
+}
+
+// Gets a page of a meal's visible ratings, newest first.
+func GetRatings(db *pgxpool.Pool, mealId string, limit int, offset int) ([]Rating, error) {
+	rows, err := db.Query(
+		context.Background(),
+		`SELECT "Ratings"."id", "Users"."displayName", "day"::text, "location", "mealtime",
+				"score", "comment", "createdAt", "updatedAt"
+			FROM "Ratings"
+			JOIN "Users" ON "Users"."id" = "Ratings"."user"
+			WHERE "mealId"=$1 AND NOT "hidden"
+			ORDER BY "day" DESC, "updatedAt" DESC
+			LIMIT $2 OFFSET $3`,
+		mealId, limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetRatings: failed db query: %v", err)
+	}
+	defer rows.Close()
+
+	ratings := []Rating{}
+	for rows.Next() {
+		var rating Rating
+		var mealtime int
+		err = rows.Scan(
+			&rating.Id, &rating.DisplayName, &rating.Day, &rating.Location, &mealtime,
+			&rating.Score, &rating.Comment, &rating.CreatedAt, &rating.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("GetRatings: failed reading row: %v", err)
+		}
+		rating.Mealtime = periodNumToName(mealtime)
+		ratings = append(ratings, rating)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetRatings: failed reading rows: %v", err)
+	}
+
+	return ratings, nil
+}
+
+// Gets the rating summaries of meals by their IDs. Meals nobody has rated are
+// left out.
+func GetRatingSummaries(db *pgxpool.Pool, mealIds []string) (map[string]RatingSummary, error) {
+	summaries := make(map[string]RatingSummary)
+
+	rows, err := db.Query(
+		context.Background(),
+		`SELECT "mealId", "score", count(*)
+			FROM "Ratings"
+			WHERE "mealId" = ANY($1) AND NOT "hidden"
+			GROUP BY "mealId", "score"`,
+		mealIds,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetRatingSummaries: failed db query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mealId string
+		var score, count int
+		if err = rows.Scan(&mealId, &score, &count); err != nil {
+			return nil, fmt.Errorf("GetRatingSummaries: failed reading row: %v", err)
+		}
+
+		summary := summaries[mealId]
+		summary.Distribution[score-1] = count
+		summary.Count += count
+		summaries[mealId] = summary
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetRatingSummaries: failed reading rows: %v", err)
+	}
+
+	for mealId, summary := range summaries {
+		total := 0
+		for i, count := range summary.Distribution {
+			total += (i + 1) * count
+		}
+		summary.Average = float64(total) / float64(summary.Count)
+		summaries[mealId] = summary
+	}
+
+	return summaries, nil
+}
+
+// Sets the Rating of every meal in menus that has been rated.
+func fillRatings(db *pgxpool.Pool, menus ...[]MealWithPreference) error {
+	var mealIds []string
+	for _, menu := range menus {
+		for _, meal := range menu {
+			mealIds = append(mealIds, meal.Id)
+		}
+	}
+	if len(mealIds) == 0 {
+		return nil
+	}
+
+	summaries, err := GetRatingSummaries(db, mealIds)
+	if err != nil {
+		return err
+	}
+
+	for _, menu := range menus {
+		for i := range menu {
+			if summary, ok := summaries[menu[i].Id]; ok {
+				menu[i].Rating = &summary
+			}
+		}
+	}
+	return nil
+}
+
+// Records that a user flagged a rating, hiding it once enough users have.
+// Flagging the same rating twice only counts once. Returns ErrRatingNotFound
+// if there is no such rating.
+func FlagRating(db *pgxpool.Pool, uid int, ratingId int64, reason string) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Locking the rating makes concurrent flags count one after another.
+	var exists int
+	err = tx.QueryRow(
+		context.Background(),
+		`SELECT 1 FROM "Ratings" WHERE "id"=$1 FOR UPDATE`,
+		ratingId,
+	).Scan(&exists)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrRatingNotFound
+	} else if err != nil {
+		return fmt.Errorf("FlagRating: failed getting rating: %v", err)
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		`INSERT INTO "RatingFlags" ("rating", "user", "reason")
+			VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`,
+		ratingId, uid, reason,
+	)
+	if err != nil {
+		return fmt.Errorf("FlagRating: failed insert: %v", err)
+	}
+
+	_, err = tx.Exec(
+		context.Background(),
+		`UPDATE "Ratings"
+			SET "hidden"=true
+			WHERE "id"=$1
+			AND (SELECT count(*) FROM "RatingFlags" WHERE "rating"=$1) >= $2`,
+		ratingId, RATING_FLAG_HIDE_THRESHOLD,
+	)
+	if err != nil {
+		return fmt.Errorf("FlagRating: failed hiding rating: %v", err)
+	}
+
+	return tx.Commit(context.Background())
+}
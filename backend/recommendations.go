@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/david-callender/FoodFinder/utils/likes"
+	"github.com/david-callender/FoodFinder/utils/matcher"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Most meals /recommendations returns.
+const MAX_RECOMMENDATIONS = 10
+
+// A meal recommended to a user, everywhere it's served on the day, and why.
+// Because is the meal the user liked that led to the recommendation, and is
+// nil for meals recommended for being popular.
+type Recommendation struct {
+	Meal        string           `json:"meal"`
+	Score       float64          `json:"score"`
+	Reason      string           `json:"reason"`
+	Because     *string          `json:"because"`
+	Occurrences []MealOccurrence `json:"occurrences"`
+}
+
+// Recommends meals served on day to a user. Meals the recommender job scored
+// for the user come first, best first, then meals popular with other users.
+// Meals the user's preferences already match or that they rated highly are
+// left out.
+func GetRecommendations(db *pgxpool.Pool, uid int, prefs *matcher.Matcher, day time.Time) ([]Recommendation, error) {
+	rated := make(map[string]bool)
+	ratingRows, err := db.Query(
+		context.Background(),
+		`SELECT DISTINCT "mealId" FROM "Ratings" WHERE "user"=$1 AND "score" >= $2`,
+		uid, likes.LIKED_RATING,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetRecommendations: failed db query: %v", err)
+	}
+	defer ratingRows.Close()
+
+	for ratingRows.Next() {
+		var mealId string
+		if err = ratingRows.Scan(&mealId); err != nil {
+			return nil, fmt.Errorf("GetRecommendations: failed reading row: %v", err)
+		}
+		rated[mealId] = true
+	}
+	if err = ratingRows.Err(); err != nil {
+		return nil, fmt.Errorf("GetRecommendations: failed reading rows: %v", err)
+	}
+	ratingRows.Close()
+
+	rows, err := db.Query(
+		context.Background(),
+		`SELECT "DocCache"."meal", "DocCache"."mealid", "DocCache"."location",
+				coalesce("Locations"."name", ''), "DocCache"."mealtime"
+			FROM "DocCache"
+			LEFT JOIN "Locations" ON "Locations"."id" = "DocCache"."location"
+			WHERE "DocCache"."day"=$1
+			ORDER BY "DocCache"."mealtime", "Locations"."name"`,
+		day.Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetRecommendations: failed db query: %v", err)
+	}
+	defer rows.Close()
+
+	// The same meal is often served at several halls, so candidates are
+	// grouped the same way the recommender groups meals.
+	candidates := make(map[string]*Recommendation)
+	liked := make(map[string]bool)
+	for rows.Next() {
+		var meal string
+		var mealtime int16
+		occurrence := MealOccurrence{Day: day.Format(time.DateOnly)}
+		err = rows.Scan(&meal, &occurrence.MealId, &occurrence.Location, &occurrence.LocationName, &mealtime)
+		if err != nil {
+			return nil, fmt.Errorf("GetRecommendations: failed reading row: %v", err)
+		}
+		occurrence.Mealtime = periodNumToName(int(mealtime))
+
+		key := matcher.Normalize(meal)
+		item := matcher.Item{Name: meal, ID: occurrence.MealId, Location: occurrence.Location, Mealtime: mealtime}
+		if prefs.Match(item) || rated[occurrence.MealId] {
+			liked[key] = true
+		}
+
+		if candidates[key] == nil {
+			candidates[key] = &Recommendation{Meal: meal}
+		}
+		candidates[key].Occurrences = append(candidates[key].Occurrences, occurrence)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetRecommendations: failed reading rows: %v", err)
+	}
+	rows.Close()
+
+	var keys []string
+	for key := range candidates {
+		if liked[key] {
+			delete(candidates, key)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return []Recommendation{}, nil
+	}
+
+	personal := make(map[string]bool)
+	scoreRows, err := db.Query(
+		context.Background(),
+		`SELECT "mealKey", "score", "because"
+			FROM "Recommendations"
+			WHERE "user"=$1 AND "mealKey" = ANY($2)`,
+		uid, keys,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetRecommendations: failed db query: %v", err)
+	}
+	defer scoreRows.Close()
+
+	for scoreRows.Next() {
+		var key, because string
+		var score float64
+		if err = scoreRows.Scan(&key, &score, &because); err != nil {
+			return nil, fmt.Errorf("GetRecommendations: failed reading row: %v", err)
+		}
+		candidate := candidates[key]
+		candidate.Score = score
+		candidate.Because = &because
+		candidate.Reason = "because you liked " + because
+		personal[key] = true
+	}
+	if err = scoreRows.Err(); err != nil {
+		return nil, fmt.Errorf("GetRecommendations: failed reading rows: %v", err)
+	}
+	scoreRows.Close()
+
+	// The user may be one of the users who like a meal, through a preference
+	// or rating that doesn't apply today, and shouldn't be told it's popular
+	// with themselves.
+	popularity := make(map[string]int)
+	popularityRows, err := db.Query(
+		context.Background(),
+		`SELECT "MealPopularity"."mealKey",
+				"MealPopularity"."likes" - ("UserLikes"."user" IS NOT NULL)::integer
+			FROM "MealPopularity"
+			LEFT JOIN "UserLikes"
+				ON "UserLikes"."mealKey" = "MealPopularity"."mealKey" AND "UserLikes"."user"=$2
+			WHERE "MealPopularity"."mealKey" = ANY($1)`,
+		keys, uid,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetRecommendations: failed db query: %v", err)
+	}
+	defer popularityRows.Close()
+
+	for popularityRows.Next() {
+		var key string
+		var likes int
+		if err = popularityRows.Scan(&key, &likes); err != nil {
+			return nil, fmt.Errorf("GetRecommendations: failed reading row: %v", err)
+		}
+		popularity[key] = likes
+		if !personal[key] && likes > 0 {
+			candidates[key].Reason = fmt.Sprintf("popular with %d other users", likes)
+		}
+	}
+	if err = popularityRows.Err(); err != nil {
+		return nil, fmt.Errorf("GetRecommendations: failed reading rows: %v", err)
+	}
+
+	// Meals with neither a score nor any likes aren't worth recommending.
+	var ranked []string
+	for _, key := range keys {
+		if personal[key] || popularity[key] > 0 {
+			ranked = append(ranked, key)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if personal[a] != personal[b] {
+			return personal[a]
+		}
+		if candidates[a].Score != candidates[b].Score {
+			return candidates[a].Score > candidates[b].Score
+		}
+		if popularity[a] != popularity[b] {
+			return popularity[a] > popularity[b]
+		}
+		return a < b
+	})
+	if len(ranked) > MAX_RECOMMENDATIONS {
+		ranked = ranked[:MAX_RECOMMENDATIONS]
+	}
+
+	recommendations := make([]Recommendation, 0, len(ranked))
+	for _, key := range ranked {
+		recommendations = append(recommendations, *candidates[key])
+	}
+	return recommendations, nil
+}
@@ -0,0 +1,239 @@
+-- Tables used by the backend in addition to "Users", "Preferences" and
+-- "DocCache". Run these against the database before starting the backend.
+
+-- One row per logged in device. The id is referenced by the "sid" claim of
+-- every token issued for the device, and "refreshId" holds the "jti" of the
+-- only refresh token that may currently be exchanged for the session.
+CREATE TABLE IF NOT EXISTS "Sessions" (
+	"id" text PRIMARY KEY,
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"refreshId" text NOT NULL,
+	"device" text NOT NULL DEFAULT '',
+	"ip" text NOT NULL DEFAULT '',
+	"createdAt" timestamptz NOT NULL DEFAULT now(),
+	"lastSeen" timestamptz NOT NULL DEFAULT now(),
+	"expiresAt" timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS "Sessions_user_idx" ON "Sessions" ("user");
+
+-- Outstanding password reset links. Only a sha256 hash of the token from the
+-- link is stored.
+CREATE TABLE IF NOT EXISTS "PasswordResets" (
+	"tokenHash" text PRIMARY KEY,
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"createdAt" timestamptz NOT NULL DEFAULT now(),
+	"expiresAt" timestamptz NOT NULL,
+	"usedAt" timestamptz
+);
+
+-- Users start out unverified and can't be sent notifications until they
+-- follow the link in their verification email.
+ALTER TABLE "Users" ADD COLUMN IF NOT EXISTS "verifiedAt" timestamptz;
+
+-- Outstanding email verification links. "email" is the address the link was
+-- sent to, so a link stops working if the user changes their email.
+CREATE TABLE IF NOT EXISTS "EmailVerifications" (
+	"tokenHash" text PRIMARY KEY,
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"email" text NOT NULL,
+	"createdAt" timestamptz NOT NULL DEFAULT now(),
+	"expiresAt" timestamptz NOT NULL,
+	"usedAt" timestamptz
+);
+CREATE INDEX IF NOT EXISTS "EmailVerifications_user_idx" ON "EmailVerifications" ("user");
+
+-- Token buckets for rate limiting when RATE_LIMIT_STORE=postgres. Keys are
+-- the limiter's name and the client's IP, like "login:127.0.0.1".
+CREATE TABLE IF NOT EXISTS "RateLimits" (
+	"key" text PRIMARY KEY,
+	"tokens" double precision NOT NULL,
+	"allowed" boolean NOT NULL,
+	"updatedAt" timestamptz NOT NULL
+);
+
+-- Failed logins per (lowercased) email when RATE_LIMIT_STORE=postgres.
+CREATE TABLE IF NOT EXISTS "LoginFailures" (
+	"email" text PRIMARY KEY,
+	"failures" integer NOT NULL,
+	"lastFailure" timestamptz NOT NULL,
+	"lockedUntil" timestamptz
+);
+
+-- Both tables are pruned by the backend of rows older than they matter.
+CREATE INDEX IF NOT EXISTS "RateLimits_updatedAt_idx" ON "RateLimits" ("updatedAt");
+CREATE INDEX IF NOT EXISTS "LoginFailures_lastFailure_idx" ON "LoginFailures" ("lastFailure");
+
+-- Logins sent to the OIDC provider that haven't come back yet. Only a hash of
+-- the state is stored; the nonce and PKCE verifier are needed in the clear to
+-- finish the login.
+CREATE TABLE IF NOT EXISTS "OidcLogins" (
+	"stateHash" text PRIMARY KEY,
+	"nonce" text NOT NULL,
+	"verifier" text NOT NULL,
+	"expiresAt" timestamptz NOT NULL
+);
+
+-- Links identities at an OIDC provider to our users.
+CREATE TABLE IF NOT EXISTS "OidcIdentities" (
+	"issuer" text NOT NULL,
+	"subject" text NOT NULL,
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"createdAt" timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY ("issuer", "subject")
+);
+
+-- Every dining location dineoncampus lists for the site, refreshed by the
+-- scraper on each run. "scraped" marks the locations whose menus the scraper
+-- caches in "DocCache".
+CREATE TABLE IF NOT EXISTS "Locations" (
+	"id" text PRIMARY KEY,
+	"building" text NOT NULL,
+	"name" text NOT NULL,
+	"scraped" boolean NOT NULL DEFAULT false,
+	"updatedAt" timestamptz NOT NULL DEFAULT now()
+);
+
+-- Trigram index for /search, which matches meal names with ILIKE and the <%
+-- word similarity operator. Both can use it, so a search doesn't have to read
+-- all of "DocCache".
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS "DocCache_meal_trgm_idx" ON "DocCache" USING gin ("meal" gin_trgm_ops);
+
+-- Preferences are rules matched against meal names. "preference" is the
+-- pattern, "matchType" is one of 'exact', 'contains', 'word' or 'regex', and a
+-- non-null "location" or "mealtime" limits the rule to that location ID or
+-- mealtime (numbered as in "DocCache"). See utils/matcher.
+ALTER TABLE "Preferences" ADD COLUMN IF NOT EXISTS "matchType" text NOT NULL DEFAULT 'exact';
+ALTER TABLE "Preferences" ADD COLUMN IF NOT EXISTS "location" text;
+ALTER TABLE "Preferences" ADD COLUMN IF NOT EXISTS "mealtime" smallint;
+
+-- When each preference was added, shown by GET /preferences.
+ALTER TABLE "Preferences" ADD COLUMN IF NOT EXISTS "createdAt" timestamptz NOT NULL DEFAULT now();
+
+-- A user can only have each preference once. "mealKey" is the pattern trimmed,
+-- with whitespace collapsed and case folded (only trimmed for regexes), so
+-- "Orange Chicken" and " orange chicken" are the same preference. The backend
+-- fills it in with matcher.Normalize; the UPDATE below approximates that for
+-- rows from before the column existed, and the DELETE drops the duplicates
+-- that turns up, keeping the oldest.
+ALTER TABLE "Preferences" ADD COLUMN IF NOT EXISTS "mealKey" text;
+UPDATE "Preferences"
+	SET "mealKey"=CASE
+		WHEN "matchType"='regex' THEN btrim("preference")
+		ELSE lower(regexp_replace(btrim("preference"), '\s+', ' ', 'g'))
+	END
+	WHERE "mealKey" IS NULL;
+DELETE FROM "Preferences" AS "p"
+	USING "Preferences" AS "q"
+	WHERE "p"."user"="q"."user" AND "p"."mealKey"="q"."mealKey"
+	AND "p"."matchType"="q"."matchType"
+	AND coalesce("p"."location", '')=coalesce("q"."location", '')
+	AND coalesce("p"."mealtime", -1)=coalesce("q"."mealtime", -1)
+	AND ("p"."createdAt", "p"."ctid") > ("q"."createdAt", "q"."ctid");
+ALTER TABLE "Preferences" ALTER COLUMN "mealKey" SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS "Preferences_rule_idx" ON "Preferences"
+	("user", "mealKey", "matchType", (coalesce("location", '')), (coalesce("mealtime", -1)));
+
+-- Every name each dineoncampus meal ID has been served under, kept by the
+-- scraper so that preferences by ID ("matchType" 'id') can be shown with the
+-- meal's current name, and names can be resolved to IDs after the menus they
+-- appeared on have left "DocCache". The INSERT seeds it from "DocCache".
+--
+-- "nameKey" is the name as matcher.Normalize leaves it, which /meals/resolve
+-- looks names up by, and the scraper fills it in for every name it sees. Rows
+-- from before it existed, and the seeded ones, get an approximation that only
+-- differs from it for names that case fold differently than they lowercase,
+-- until they're next scraped.
+CREATE TABLE IF NOT EXISTS "MealNames" (
+	"mealId" text NOT NULL,
+	"name" text NOT NULL,
+	"firstSeen" date NOT NULL,
+	"lastSeen" date NOT NULL,
+	PRIMARY KEY ("mealId", "name")
+);
+ALTER TABLE "MealNames" ADD COLUMN IF NOT EXISTS "nameKey" text;
+UPDATE "MealNames" SET "nameKey"=lower(regexp_replace(btrim("name"), '\s+', ' ', 'g'))
+	WHERE "nameKey" IS NULL;
+ALTER TABLE "MealNames" ALTER COLUMN "nameKey" SET NOT NULL;
+DROP INDEX IF EXISTS "MealNames_name_idx";
+CREATE INDEX IF NOT EXISTS "MealNames_nameKey_idx" ON "MealNames" ("nameKey");
+INSERT INTO "MealNames" ("mealId", "name", "nameKey", "firstSeen", "lastSeen")
+	SELECT "mealid", "meal", lower(regexp_replace(btrim("meal"), '\s+', ' ', 'g')), min("day"), max("day")
+		FROM "DocCache"
+		WHERE "mealid" <> ''
+		GROUP BY "mealid", "meal"
+	ON CONFLICT DO NOTHING;
+
+-- Users' 1 to 5 ratings of meals, with an optional comment. Each is for one
+-- occurrence of a meal: the day, location and mealtime it was served. A
+-- rating is hidden once RATING_FLAG_HIDE_THRESHOLD users have flagged it, and
+-- hidden ratings don't count towards a meal's score.
+CREATE TABLE IF NOT EXISTS "Ratings" (
+	"id" bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"mealId" text NOT NULL,
+	"day" date NOT NULL,
+	"location" text NOT NULL,
+	"mealtime" smallint NOT NULL,
+	"score" smallint NOT NULL CHECK ("score" BETWEEN 1 AND 5),
+	"comment" text NOT NULL DEFAULT '',
+	"hidden" boolean NOT NULL DEFAULT false,
+	"createdAt" timestamptz NOT NULL DEFAULT now(),
+	"updatedAt" timestamptz NOT NULL DEFAULT now(),
+	UNIQUE ("user", "mealId", "day", "location", "mealtime")
+);
+CREATE INDEX IF NOT EXISTS "Ratings_mealId_idx" ON "Ratings" ("mealId");
+
+-- One row per user who has flagged a rating for moderation.
+CREATE TABLE IF NOT EXISTS "RatingFlags" (
+	"rating" bigint NOT NULL REFERENCES "Ratings" ("id") ON DELETE CASCADE,
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"reason" text NOT NULL DEFAULT '',
+	"createdAt" timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY ("rating", "user")
+);
+
+-- Written by the recommender batch job, which replaces both tables on every
+-- run. Meals are identified by "mealKey", their name normalized the same way
+-- as "Preferences"."mealKey". "because" is the name of the meal the user
+-- liked that contributed most to the recommendation.
+CREATE TABLE IF NOT EXISTS "Recommendations" (
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"mealKey" text NOT NULL,
+	"score" double precision NOT NULL,
+	"because" text NOT NULL,
+	"computedAt" timestamptz NOT NULL,
+	PRIMARY KEY ("user", "mealKey")
+);
+
+-- How many users like each meal, for recommending to users the recommender
+-- has nothing personal for.
+CREATE TABLE IF NOT EXISTS "MealPopularity" (
+	"mealKey" text PRIMARY KEY,
+	"name" text NOT NULL,
+	"likes" integer NOT NULL,
+	"computedAt" timestamptz NOT NULL
+);
+
+-- The meals the recommender counted each user as liking, so that a user's own
+-- like can be left out of the popularity they are shown.
+CREATE TABLE IF NOT EXISTS "UserLikes" (
+	"user" integer NOT NULL REFERENCES "Users" ("id") ON DELETE CASCADE,
+	"mealKey" text NOT NULL,
+	PRIMARY KEY ("user", "mealKey")
+);
+
+-- The refresh token a session's current one replaced, which is still accepted
+-- for a moment after "rotatedAt" so that concurrent refreshes with the same
+-- cookie don't revoke the session.
+ALTER TABLE "Sessions" ADD COLUMN IF NOT EXISTS "prevRefreshId" text;
+ALTER TABLE "Sessions" ADD COLUMN IF NOT EXISTS "rotatedAt" timestamptz;
+
+-- Emails are unique ignoring case, so two concurrent signups or email changes
+-- can't both claim the same address. Creating this fails if "Users" already
+-- has emails that only differ in case, which have to be merged by hand first.
+CREATE UNIQUE INDEX IF NOT EXISTS "Users_email_lower_idx" ON "Users" (lower("email"));
+
+-- For looking up the menu cache by day, such as the recent past that
+-- /preferences checks for when each preference was last served.
+CREATE INDEX IF NOT EXISTS "DocCache_day_idx" ON "DocCache" ("day");
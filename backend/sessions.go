@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// How long a refresh token that was just exchanged is still accepted. A page
+// that sends several requests at once refreshes once per request, all with
+// the same cookie, and only the first of those can be the one that rotates it.
+const REFRESH_REUSE_GRACE = time.Second * 30
+
+// A single logged in device. Sessions are created at login/signup, referenced
+// by the "sid" claim of every token issued for that device, and removed on
+// logout.
+//
+// A session is also the family of the refresh tokens issued for it. Only the
+// most recently issued refresh token (RefreshId, its "jti" claim) may be
+// exchanged at /refresh, so presenting any older token from the same family
+// means it was replayed. The exception is the token it replaced
+// (PrevRefreshId), which is still accepted for REFRESH_REUSE_GRACE after
+// RotatedAt so that concurrent refreshes don't look like a replay.
+type Session struct {
+	ID            string    `json:"id"`
+	UserID        int       `json:"-"`
+	RefreshId     string    `json:"-"`
+	PrevRefreshId string    `json:"-"`
+	RotatedAt     time.Time `json:"-"`
+	Device        string    `json:"device"`
+	IP            string    `json:"ip"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastSeen      time.Time `json:"lastSeen"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+// Storage for logged in sessions. Implementations must be safe for concurrent
+// use since they are shared by every gin handler.
+type SessionStore interface {
+	// Creates a new session from the UserID, RefreshId, Device, IP and
+	// ExpiresAt fields of session. RefreshId is the jti of the first refresh
+	// token issued for the session. Returns the session with the rest of its
+	// fields filled in.
+	Create(ctx context.Context, session Session) (Session, error)
+	// Finds an unexpired session by its ID. Returns ErrSessionNotFound if the
+	// session doesn't exist or has expired.
+	Get(ctx context.Context, id string) (Session, error)
+	// Lists every unexpired session belonging to a user, most recently seen
+	// first.
+	ListForUser(ctx context.Context, uid int) ([]Session, error)
+	// Swaps the session's current refresh token from oldRefreshId to
+	// newRefreshId, marks the session as seen now and pushes its expiry back
+	// to expiresAt. Returns the refresh ID the new refresh token should be
+	// issued with, which is newRefreshId unless oldRefreshId was rotated out
+	// less than REFRESH_REUSE_GRACE ago, in which case the session is left
+	// alone and its current refresh ID is returned. Returns
+	// ErrRefreshTokenReused if oldRefreshId is any other refresh token, or
+	// ErrSessionNotFound if the session doesn't exist.
+	Rotate(ctx context.Context, id string, oldRefreshId string, newRefreshId string, expiresAt time.Time) (string, error)
+	// Removes a single session.
+	Delete(ctx context.Context, id string) error
+	// Removes every session belonging to a user.
+	DeleteForUser(ctx context.Context, uid int) error
+}
+
+// Generates a random, url safe identifier suitable for session IDs and other
+// opaque tokens.
+func newRandomId() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random id: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Hashes an opaque token for storage, so that a leaked table can't be used to
+// redeem the tokens in it.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Reports whether refreshId is the refresh token session's current one
+// replaced less than REFRESH_REUSE_GRACE before now.
+func withinReuseGrace(session Session, refreshId string, now time.Time) bool {
+	return refreshId != "" &&
+		refreshId == session.PrevRefreshId &&
+		now.Sub(session.RotatedAt) < REFRESH_REUSE_GRACE
+}
+
+// SessionStore backed by the "Sessions" table.
+type PgSessionStore struct {
+	DB *pgxpool.Pool
+}
+
+func NewPgSessionStore(db *pgxpool.Pool) *PgSessionStore {
+	return &PgSessionStore{DB: db}
+}
+
+func (p *PgSessionStore) Create(ctx context.Context, session Session) (Session, error) {
+	id, err := newRandomId()
+	if err != nil {
+		return Session{}, err
+	}
+
+	session.ID = id
+	err = p.DB.QueryRow(ctx, `
+		INSERT INTO "Sessions" ("id", "user", "refreshId", "device", "ip", "expiresAt")
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING "createdAt", "lastSeen"`,
+		id, session.UserID, session.RefreshId, session.Device, session.IP, session.ExpiresAt,
+	).Scan(&session.CreatedAt, &session.LastSeen)
+
+	if err != nil {
+		return Session{}, fmt.Errorf("failed to insert session: %w", err)
+	}
+	return session, nil
+}
+
+func (p *PgSessionStore) Get(ctx context.Context, id string) (Session, error) {
+	session := Session{ID: id}
+	err := p.DB.QueryRow(ctx, `
+		SELECT "user", "refreshId", coalesce("prevRefreshId", ''), coalesce("rotatedAt", "createdAt"),
+				"device", "ip", "createdAt", "lastSeen", "expiresAt"
+			FROM "Sessions"
+			WHERE "id"=$1 AND "expiresAt" > now()`,
+		id,
+	).Scan(&session.UserID, &session.RefreshId, &session.PrevRefreshId, &session.RotatedAt, &session.Device, &session.IP, &session.CreatedAt, &session.LastSeen, &session.ExpiresAt)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Session{}, ErrSessionNotFound
+	} else if err != nil {
+		return Session{}, fmt.Errorf("failed to get session: %w", err)
+	}
+	return session, nil
+}
+
+func (p *PgSessionStore) ListForUser(ctx context.Context, uid int) ([]Session, error) {
+	rows, err := p.DB.Query(ctx, `
+		SELECT "id", "refreshId", "device", "ip", "createdAt", "lastSeen", "expiresAt"
+			FROM "Sessions"
+			WHERE "user"=$1 AND "expiresAt" > now()
+			ORDER BY "lastSeen" DESC`,
+		uid,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Session, error) {
+		session := Session{UserID: uid}
+		err := row.Scan(&session.ID, &session.RefreshId, &session.Device, &session.IP, &session.CreatedAt, &session.LastSeen, &session.ExpiresAt)
+		return session, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+func (p *PgSessionStore) Rotate(ctx context.Context, id string, oldRefreshId string, newRefreshId string, expiresAt time.Time) (string, error) {
+	// Comparing against the old refresh ID in the same statement that replaces
+	// it means two concurrent refreshes with the same token can't both win.
+	tag, err := p.DB.Exec(ctx, `
+		UPDATE "Sessions"
+			SET "prevRefreshId"="refreshId", "refreshId"=$3, "rotatedAt"=now(),
+				"lastSeen"=now(), "expiresAt"=$4
+			WHERE "id"=$1 AND "refreshId"=$2 AND "expiresAt" > now()`,
+		id, oldRefreshId, newRefreshId, expiresAt,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate session: %w", err)
+	}
+	if tag.RowsAffected() != 0 {
+		return newRefreshId, nil
+	}
+
+	// Nothing was updated, so either the session is gone or the refresh token
+	// has already been swapped out, possibly by a concurrent refresh that
+	// was sent with the same token.
+	session, err := p.Get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if withinReuseGrace(session, oldRefreshId, time.Now()) {
+		return session.RefreshId, nil
+	}
+	return "", ErrRefreshTokenReused
+}
+
+func (p *PgSessionStore) Delete(ctx context.Context, id string) error {
+	_, err := p.DB.Exec(ctx, `DELETE FROM "Sessions" WHERE "id"=$1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+func (p *PgSessionStore) DeleteForUser(ctx context.Context, uid int) error {
+	_, err := p.DB.Exec(ctx, `DELETE FROM "Sessions" WHERE "user"=$1`, uid)
+	if err != nil {
+		return fmt.Errorf("failed to delete sessions for user: %w", err)
+	}
+	return nil
+}
+
+// SessionStore kept entirely in memory. Sessions are lost on restart, so this
+// is only meant for tests and local development without a database.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]Session{}}
+}
+
+func (m *MemorySessionStore) Create(ctx context.Context, session Session) (Session, error) {
+	id, err := newRandomId()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	session.ID = id
+	session.CreatedAt = now
+	session.LastSeen = now
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[id] = session
+	return session, nil
+}
+
+func (m *MemorySessionStore) Get(ctx context.Context, id string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok || !session.ExpiresAt.After(time.Now()) {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (m *MemorySessionStore) ListForUser(ctx context.Context, uid int) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := make([]Session, 0)
+	now := time.Now()
+	for _, session := range m.sessions {
+		if session.UserID == uid && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+func (m *MemorySessionStore) Rotate(ctx context.Context, id string, oldRefreshId string, newRefreshId string, expiresAt time.Time) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	session, ok := m.sessions[id]
+	if !ok || !session.ExpiresAt.After(now) {
+		return "", ErrSessionNotFound
+	}
+	if session.RefreshId != oldRefreshId {
+		if withinReuseGrace(session, oldRefreshId, now) {
+			return session.RefreshId, nil
+		}
+		return "", ErrRefreshTokenReused
+	}
+	session.PrevRefreshId = session.RefreshId
+	session.RefreshId = newRefreshId
+	session.RotatedAt = now
+	session.LastSeen = now
+	session.ExpiresAt = expiresAt
+	m.sessions[id] = session
+	return newRefreshId, nil
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteForUser(ctx context.Context, uid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.sessions {
+		if session.UserID == uid {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestSession(t *testing.T, store *MemorySessionStore, refreshId string) Session {
+	t.Helper()
+	session, err := store.Create(context.Background(), Session{
+		UserID:    1,
+		RefreshId: refreshId,
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return session
+}
+
+func TestMemorySessionStoreRotate(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemorySessionStore()
+	session := newTestSession(t, store, "r0")
+
+	expiresAt := time.Now().Add(2 * time.Hour)
+	refreshId, err := store.Rotate(ctx, session.ID, "r0", "r1", expiresAt)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if refreshId != "r1" {
+		t.Errorf("Rotate returned %q, want r1", refreshId)
+	}
+
+	got, err := store.Get(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.RefreshId != "r1" || got.PrevRefreshId != "r0" {
+		t.Errorf("refresh IDs = (%q, %q), want (r1, r0)", got.RefreshId, got.PrevRefreshId)
+	}
+	if !got.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", got.ExpiresAt, expiresAt)
+	}
+}
+
+func TestMemorySessionStoreRotateWithinGrace(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemorySessionStore()
+	session := newTestSession(t, store, "r0")
+
+	if _, err := store.Rotate(ctx, session.ID, "r0", "r1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+
+	// A second refresh sent with the same cookie gets the token the first
+	// one rotated to, and doesn't rotate again.
+	refreshId, err := store.Rotate(ctx, session.ID, "r0", "r2", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Rotate within grace: %v", err)
+	}
+	if refreshId != "r1" {
+		t.Errorf("Rotate within grace returned %q, want r1", refreshId)
+	}
+
+	got, _ := store.Get(ctx, session.ID)
+	if got.RefreshId != "r1" {
+		t.Errorf("RefreshId = %q, want r1", got.RefreshId)
+	}
+}
+
+func TestMemorySessionStoreRotateReused(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemorySessionStore()
+
+	t.Run("after grace", func(t *testing.T) {
+		session := newTestSession(t, store, "r0")
+		if _, err := store.Rotate(ctx, session.ID, "r0", "r1", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+
+		// Pretend the rotation happened long enough ago.
+		store.mu.Lock()
+		rotated := store.sessions[session.ID]
+		rotated.RotatedAt = time.Now().Add(-REFRESH_REUSE_GRACE)
+		store.sessions[session.ID] = rotated
+		store.mu.Unlock()
+
+		_, err := store.Rotate(ctx, session.ID, "r0", "r2", time.Now().Add(time.Hour))
+		if !errors.Is(err, ErrRefreshTokenReused) {
+			t.Errorf("Rotate = %v, want ErrRefreshTokenReused", err)
+		}
+	})
+
+	t.Run("older token", func(t *testing.T) {
+		session := newTestSession(t, store, "r0")
+		for _, ids := range [][2]string{{"r0", "r1"}, {"r1", "r2"}} {
+			if _, err := store.Rotate(ctx, session.ID, ids[0], ids[1], time.Now().Add(time.Hour)); err != nil {
+				t.Fatalf("Rotate %s: %v", ids[0], err)
+			}
+		}
+
+		// r0 was replaced two rotations ago, so it is a replay even though
+		// the grace period hasn't passed.
+		_, err := store.Rotate(ctx, session.ID, "r0", "r3", time.Now().Add(time.Hour))
+		if !errors.Is(err, ErrRefreshTokenReused) {
+			t.Errorf("Rotate = %v, want ErrRefreshTokenReused", err)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		session := newTestSession(t, store, "r0")
+		_, err := store.Rotate(ctx, session.ID, "", "r1", time.Now().Add(time.Hour))
+		if !errors.Is(err, ErrRefreshTokenReused) {
+			t.Errorf("Rotate = %v, want ErrRefreshTokenReused", err)
+		}
+	})
+}
+
+func TestMemorySessionStoreRotateMissing(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemorySessionStore()
+
+	_, err := store.Rotate(ctx, "missing", "r0", "r1", time.Now().Add(time.Hour))
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Rotate missing = %v, want ErrSessionNotFound", err)
+	}
+
+	expired, err := store.Create(ctx, Session{UserID: 1, RefreshId: "r0", ExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	_, err = store.Rotate(ctx, expired.ID, "r0", "r1", time.Now().Add(time.Hour))
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Rotate expired = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestMemorySessionStoreDeleteForUser(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemorySessionStore()
+	mine := newTestSession(t, store, "r0")
+	other, err := store.Create(ctx, Session{UserID: 2, RefreshId: "r0", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := store.DeleteForUser(ctx, 1); err != nil {
+		t.Fatalf("DeleteForUser: %v", err)
+	}
+	if _, err := store.Get(ctx, mine.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Get deleted session = %v, want ErrSessionNotFound", err)
+	}
+	if _, err := store.Get(ctx, other.ID); err != nil {
+		t.Errorf("Get other user's session: %v", err)
+	}
+}
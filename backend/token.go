@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
@@ -14,28 +14,36 @@ import (
 const ACCESS_TOKEN_KEEPALIVE = time.Minute * 7
 const REFRESH_TOKEN_KEEPALIVE = time.Hour * 24 * 10
 
-// Generates a new pair of access and refresh tokens. Returns (access_token,
+// Values of the "typ" claim, which keeps refresh tokens from being used as
+// access tokens and vice versa.
+const ACCESS_TOKEN_TYPE = "access"
+const REFRESH_TOKEN_TYPE = "refresh"
+
+// Generates a new pair of access and refresh tokens for a session. refreshId
+// becomes the refresh token's "jti" claim. Returns (access_token,
 // refresh_token).
-func generateToken(userid int) (string, string, error) {
+func (s *Server) generateToken(userid int, sessionId string, refreshId string) (string, string, error) {
 	creation_time := time.Now()
 
-	access_token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	sign_access, err := s.Keys.Sign(jwt.MapClaims{
+		"typ": ACCESS_TOKEN_TYPE,
 		"sub": strconv.Itoa(userid),
+		"sid": sessionId,
 		"iat": creation_time.Unix(),
 		"exp": creation_time.Add(ACCESS_TOKEN_KEEPALIVE).Unix(),
 	})
-	refresh_token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": strconv.Itoa(userid),
-		"iat": creation_time.Unix(),
-		"exp": creation_time.Add(REFRESH_TOKEN_KEEPALIVE).Unix(),
-	})
-
-	sign_access, err := access_token.SignedString([]byte(os.Getenv("access_key")))
 	if err != nil {
 		return "", "", fmt.Errorf("failed to generate access token: %w", err)
 	}
 
-	sign_refresh, err := refresh_token.SignedString([]byte(os.Getenv("refresh_key")))
+	sign_refresh, err := s.Keys.Sign(jwt.MapClaims{
+		"typ": REFRESH_TOKEN_TYPE,
+		"sub": strconv.Itoa(userid),
+		"sid": sessionId,
+		"jti": refreshId,
+		"iat": creation_time.Unix(),
+		"exp": creation_time.Add(REFRESH_TOKEN_KEEPALIVE).Unix(),
+	})
 	if err != nil {
 		return "", "", fmt.Errorf("failed to generate refresh token: %w", err)
 	}
@@ -43,58 +51,104 @@ func generateToken(userid int) (string, string, error) {
 	return sign_access, sign_refresh, nil
 }
 
-// Verifies a jwt token
-func verifyToken(tokenString string, secretKey []byte) (jwt.MapClaims, error) {
+// Verifies a jwt token of the given type. The key it was signed with is picked
+// by its "kid" header.
+func (s *Server) verifyToken(tokenString string, tokenType string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, err := s.Keys.Lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, jwt.ErrSignatureInvalid
 		}
-		return secretKey, nil
+		return key.Public, nil
 	})
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if claims["typ"] != tokenType {
+		return nil, fmt.Errorf("expected %s token", tokenType)
 	}
-	return nil, fmt.Errorf("invalid token")
+	return claims, nil
 }
 
-func (s *Server) protectRoute(accessToken string) (int, error) {
-	accessKey := os.Getenv("access_key")
+// Reads the user ID and session ID out of verified token claims.
+func tokenSession(claims jwt.MapClaims) (int, string, error) {
+	subjectStr, err := claims.GetSubject()
 
-	token, err := verifyToken(accessToken, []byte(accessKey))
+	if err != nil || subjectStr == "" {
+		return 0, "", fmt.Errorf("no subject in token: %w", err)
+	}
+
+	subject, err := strconv.Atoi(subjectStr)
 
 	if err != nil {
-		return 0, fmt.Errorf("failed to verify token: %w", err)
+		return 0, "", fmt.Errorf("invalid subject: %w", err)
 	}
 
-	subjectStr, ok := token["sub"]
+	sessionId, ok := claims["sid"].(string)
 
-	if !ok {
-		return 0, fmt.Errorf("no subject in token: %w", err)
+	if !ok || sessionId == "" {
+		return 0, "", fmt.Errorf("no session in token")
 	}
 
-	subject, err := strconv.Atoi(subjectStr.(string))
+	return subject, sessionId, nil
+}
+
+// Checks that the session a token was issued for still exists and belongs to
+// the token's subject.
+func (s *Server) checkSession(ctx context.Context, uid int, sessionId string) error {
+	session, err := s.Sessions.Get(ctx, sessionId)
 
 	if err != nil {
-		return 0, fmt.Errorf("invalid subject: %w", err)
+		return fmt.Errorf("not logged in: %w", err)
 	}
 
-	loggedIn, ok := s.LoggedIn[subject]
+	if session.UserID != uid {
+		return fmt.Errorf("not logged in: session belongs to another user")
+	}
+
+	return nil
+}
 
-	if !(ok && loggedIn) {
-		return 0, fmt.Errorf("not logged in")
+// Verifies an access token and checks that its session is still logged in.
+// Returns the user ID and the ID of the session the token was issued for.
+func (s *Server) protectRoute(accessToken string) (int, string, error) {
+	token, err := s.verifyToken(accessToken, ACCESS_TOKEN_TYPE)
+
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	subject, sessionId, err := tokenSession(token)
+
+	if err != nil {
+		return 0, "", err
 	}
 
-	return subject, nil
+	err = s.checkSession(context.Background(), subject, sessionId)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	return subject, sessionId, nil
 }
 
-// adds the refresh token to the http cookies and returns the access token
-func RefreshCookieTemplate(c *gin.Context, uid int) (string, error) {
-	access, refresh, err := generateToken(uid)
+// adds the refresh token for a session to the http cookies and returns the
+// access token. refreshId must already be recorded as the session's current
+// refresh token.
+func (s *Server) RefreshCookieTemplate(c *gin.Context, uid int, sessionId string, refreshId string) (string, error) {
+	access, refresh, err := s.generateToken(uid, sessionId, refreshId)
 
 	if err != nil {
 		return "", err
@@ -113,4 +167,41 @@ func RefreshCookieTemplate(c *gin.Context, uid int) (string, error) {
 	})
 
 	return access, nil
-}
\ No newline at end of file
+}
+
+// Logs a user in on the device making the request. Creates a new session,
+// adds its refresh token to the http cookies and returns the access token.
+func (s *Server) startSession(c *gin.Context, uid int) (string, error) {
+	refreshId, err := newRandomId()
+
+	if err != nil {
+		return "", err
+	}
+
+	session, err := s.Sessions.Create(c.Request.Context(), Session{
+		UserID:    uid,
+		RefreshId: refreshId,
+		Device:    c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+		ExpiresAt: time.Now().Add(REFRESH_TOKEN_KEEPALIVE),
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return s.RefreshCookieTemplate(c, uid, session.ID, refreshId)
+}
+
+// tells the browser to delete the refresh token cookie
+func clearRefreshCookie(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1, // tells browser to delete
+		HttpOnly: true,
+		Secure:   false, // set true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+	})
+}
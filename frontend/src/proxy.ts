@@ -2,11 +2,18 @@
 // which basically means it runs closer to the browser level
 // this is needed in middleware because middleware is working
 // more "barebones" so to speak with requests, etc. BEFORE any rendering
-import { jwtVerify } from "jose";
+import { createRemoteJWKSet, jwtVerify } from "jose";
 import { NextResponse } from "next/server";
 
 import type { NextRequest } from "next/server";
 
+// The backend signs tokens with keys it publishes here. jose caches the key
+// set and refetches it when it sees a token signed with a key it doesn't know,
+// so the backend can roll its keys without us having to change anything.
+const JWKS = createRemoteJWKSet(
+  new URL("/.well-known/jwks.json", process.env.NEXT_PUBLIC_BACKEND_URL)
+);
+
 async function authenticate(
   refresh_token: string | undefined
 ): Promise<boolean> {
@@ -17,15 +24,8 @@ async function authenticate(
   if (refresh_token === undefined || refresh_token === "") {
     return false;
   }
-  // need to encode secret for verification
-  // Per chatgpt: jose is built on WEB Crypto API, the only library available for edge runtime.
-  // this library requires secret keys to be encoded
-  const refresh_secret = new TextEncoder().encode(
-    process.env.refresh_key?.trim()
-  );
-
   try {
-    const { payload } = await jwtVerify(refresh_token, refresh_secret);
+    const { payload } = await jwtVerify(refresh_token, JWKS);
     console.log(payload);
     return true;
   } catch (error) {
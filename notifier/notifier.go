@@ -9,6 +9,9 @@ import (
 	"time"
 
 	docclient "github.com/david-callender/FoodFinder/utils/dineocclient"
+	"github.com/david-callender/FoodFinder/utils/likes"
+	"github.com/david-callender/FoodFinder/utils/mailer"
+	"github.com/david-callender/FoodFinder/utils/matcher"
 	"github.com/jackc/pgx/v5"
 	"github.com/wneessen/go-mail"
 )
@@ -17,15 +20,12 @@ import (
 // Generic Global Values
 var mealtimeIndexer = [4]string{"breakfast", "lunch", "dinner", "every day"}
 
-const EMAIL_HOST = "<EMAIL_SERVER_HOSTNAME>"
 const NOTIFICATION_SUBJECT = "GopherGrub Notification"
 const TIME_DAY = 24 * time.Hour
 const UMN_SITE_ID = "61d7515eb63f1e0e970debbei"
 
 // Errors
 var errNoConnString = errors.New("notifier: DATABASE_URL is not set, we cannot connect to the database")
-var errNoEmail = errors.New("notifier: NOTIFIER_EMAIL is not set, we don't have an email address")
-var errNoPass = errors.New("notifier: NOTIFIER_PASSWORD is not set, we cannot authenticate with no password")
 var errTimeNotProvided = errors.New("notifier: Please provide a ISO YYYY-MM-DD date string as an argument")
 
 // Types
@@ -62,16 +62,11 @@ func generateMessages(notificationTable map[int][]mealNotification, emailTable m
 
 	var messages = make([]*mail.Msg, 0)
 	for userId, notifs := range notificationTable {
-		message := mail.NewMsg()
-		errs := errors.Join(
-			message.From(os.Getenv("NOTIFIER_EMAIL")),
-			message.ToFromString(emailTable[userId]),
-		)
-		if errs != nil {
-			return nil, errs
+		// Users without a verified email aren't in the email table, and
+		// we don't want to mail addresses that might be typos.
+		if _, ok := emailTable[userId]; !ok {
+			continue
 		}
-		message.Subject(NOTIFICATION_SUBJECT)
-		message.SetBulk()
 		messageBody := "Some of your favorite foods are available today!\n\n"
 		for _, notif := range notifs {
 			messageBody += fmt.Sprintf(
@@ -81,7 +76,11 @@ func generateMessages(notificationTable map[int][]mealNotification, emailTable m
 				mealtimeIndexer[notif.mealTime],
 			)
 		}
-		message.SetBodyString("text/plain", messageBody)
+		message, err := mailer.NewMessage(emailTable[userId], NOTIFICATION_SUBJECT, messageBody)
+		if err != nil {
+			return nil, err
+		}
+		message.SetBulk()
 		messages = append(messages, message)
 	}
 
@@ -121,7 +120,8 @@ func notifyUsers(conn *pgx.Conn, date time.Time) error {
 		`SELECT id, email
 			FROM "Users"
 			JOIN "Preferences"
-			ON "Users".id = "Preferences".user;`,
+			ON "Users".id = "Preferences".user
+			WHERE "Users"."verifiedAt" IS NOT NULL;`,
 	)
 	if err != nil {
 		return err
@@ -138,14 +138,24 @@ func notifyUsers(conn *pgx.Conn, date time.Time) error {
 	}
 	userEmails.Close()
 
-	usersToNotify, err := conn.Query(
+	// Users whose rules don't compile are left out rather than holding up
+	// everyone else's notifications.
+	userMatchers, invalid, err := likes.LoadUserMatchers(context.Background(), conn)
+	if err != nil {
+		return err
+	}
+	for userId, err := range invalid {
+		log.Printf("notifier: skipping user %d with invalid preferences: %v\n", userId, err)
+	}
+
+	// Preferences can be regexes, so rather than joining them against the
+	// DocCache in SQL we check each of the day's meals against every user's
+	// rules.
+	mealRows, err := conn.Query(
 		context.Background(),
-		`SELECT user, meal, location, mealtime 
-			FROM "Preferences"
-			JOIN "DocCache" 
-			ON "Preferences".preference = "DocCache".meal 
-			WHERE day=$1
-			ORDER BY user;`,
+		`SELECT meal, mealid, location, mealtime
+			FROM "DocCache"
+			WHERE day=$1;`,
 		dateFormatted,
 	)
 	if err != nil {
@@ -153,16 +163,28 @@ func notifyUsers(conn *pgx.Conn, date time.Time) error {
 	}
 
 	var notificationTable = make(map[int][]mealNotification)
-	for usersToNotify.Next() {
+	for mealRows.Next() {
 		// Again we can't short declare since Scan takes a reference.
-		var notif mealNotification
-		err = usersToNotify.Scan(&notif.user, &notif.meal, &notif.location, &notif.mealTime)
+		var item matcher.Item
+		err = mealRows.Scan(&item.Name, &item.ID, &item.Location, &item.Mealtime)
 		if err != nil {
 			return err
 		}
-		notificationTable[notif.user] = append(notificationTable[notif.user], notif)
+		for userId, userMatcher := range userMatchers {
+			if userMatcher.Match(item) {
+				notificationTable[userId] = append(notificationTable[userId], mealNotification{
+					user:     userId,
+					meal:     item.Name,
+					location: item.Location,
+					mealTime: item.Mealtime,
+				})
+			}
+		}
+	}
+	mealRows.Close()
+	if err = mealRows.Err(); err != nil {
+		return err
 	}
-	usersToNotify.Close()
 
 	messages, err := generateMessages(notificationTable, emailTable)
 	if err != nil {
@@ -213,31 +235,8 @@ func runNotifier() error {
 	return err
 }
 
-// sendMessages(messages): takes a slice of references to mail.Msg emails, obtains
-// its email address and password from the environment, and uses the credentials
-// to send all of the messages. Returns non-nil error on failure.
+// sendMessages(messages): takes a slice of references to mail.Msg emails and
+// sends them with the shared mailer. Returns non-nil error on failure.
 func sendMessages(messages []*mail.Msg) error {
-	notifierEmail := os.Getenv("NOTIFIER_EMAIL")
-	if notifierEmail == "" {
-		return errNoEmail
-	}
-	notifierPassword := os.Getenv("NOTIFIER_PASSWORD")
-	if notifierPassword == "" {
-		return errNoPass
-	}
-	mailer, err := mail.NewClient(
-		EMAIL_HOST,
-		mail.WithUsername(notifierEmail),
-		mail.WithPassword(notifierPassword),
-		mail.WithSMTPAuth(mail.SMTPAuthPlain),
-	)
-	if err != nil {
-		return err
-	}
-
-	if err = mailer.DialAndSend(messages...); err != nil {
-		return err
-	}
-
-	return nil
+	return mailer.Send(messages...)
 }
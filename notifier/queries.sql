@@ -1,11 +1,12 @@
--- Select all matches between user preferences and the DocCache table
-SELECT user, meal 
-	FROM "Preferences"
-	JOIN "DocCache" 
-	ON "Preferences.preference" = "DocCache.meal" 
-	WHERE day="2025-03-03"
-	ORDER BY user;
+-- Select every preference rule. These are compiled with utils/matcher and
+-- checked against each of the day's meals, since regex rules can't be joined.
+SELECT "user", preference, "matchType", location, mealtime FROM "Preferences";
+
+-- Select all meals served on a given date.
+SELECT meal, mealid, location, mealtime FROM "DocCache" WHERE day='2025-03-03';
 
 -- Select emails from the users table where the user is in the preferences table
+-- and has verified their email address.
 -- We would then build a map from uid to email from this table
-SELECT email, id FROM "Users" JOIN "Preferences" ON "Users.id" = "Preferences.user";
+SELECT email, id FROM "Users" JOIN "Preferences" ON "Users.id" = "Preferences.user"
+	WHERE "Users"."verifiedAt" IS NOT NULL;
@@ -0,0 +1,17 @@
+module github.com/david-callender/FoodFinder/recommender
+
+go 1.25.1
+
+replace github.com/david-callender/FoodFinder/utils => ../utils
+
+require (
+	github.com/david-callender/FoodFinder/utils v0.0.0-00010101000000-000000000000
+	github.com/jackc/pgx/v5 v5.7.6
+)
+
+require (
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
+	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
+)
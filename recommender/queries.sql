@@ -0,0 +1,36 @@
+-- Select every preference rule. These are compiled with utils/matcher and
+-- checked against every meal in the cache to find what each user likes.
+SELECT "user", preference, "matchType", location, mealtime FROM "Preferences";
+
+-- Select every distinct meal in the cache with the last day it was served.
+SELECT meal, mealid, location, mealtime, max(day)::text
+	FROM "DocCache"
+	GROUP BY meal, mealid, location, mealtime;
+
+-- Select the name each highly rated meal was last served under, per user,
+-- with the last day the user had it.
+SELECT "rated"."user", "named"."name", "rated"."day"::text
+	FROM (
+		SELECT "user", "mealId", max("day") AS "day"
+			FROM "Ratings"
+			WHERE "score" >= 4 AND NOT "hidden"
+			GROUP BY "user", "mealId"
+	) AS "rated"
+	JOIN LATERAL (
+		SELECT "name"
+			FROM "MealNames"
+			WHERE "MealNames"."mealId" = "rated"."mealId"
+			ORDER BY "lastSeen" DESC, "name"
+			LIMIT 1
+	) AS "named" ON true;
+
+-- Replace the recommendations. Done in one transaction along with the likes
+-- and popularity tables.
+DELETE FROM "UserLikes";
+INSERT INTO "UserLikes" ("user", "mealKey") VALUES (1, '<MEAL KEY>');
+DELETE FROM "Recommendations";
+INSERT INTO "Recommendations" ("user", "mealKey", "score", "because", "computedAt")
+	VALUES (1, '<MEAL KEY>', 0.5, '<LIKED MEAL NAME>', now());
+DELETE FROM "MealPopularity";
+INSERT INTO "MealPopularity" ("mealKey", "name", "likes", "computedAt")
+	VALUES ('<MEAL KEY>', '<MEAL NAME>', 3, now());
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/david-callender/FoodFinder/utils/likes"
+	"github.com/david-callender/FoodFinder/utils/matcher"
+	"github.com/jackc/pgx/v5"
+)
+
+// Global Constant Storage
+
+// Only this many of a user's liked meals are used to find similar meals, since
+// the work grows with the square of it. A broad rule like "contains chicken"
+// can easily match hundreds of meals. The most recently served or rated are
+// the ones kept.
+const MAX_LIKES_PER_USER = 200
+
+// How many recommendations are kept for each user.
+const MAX_RECOMMENDATIONS_PER_USER = 100
+
+// Errors
+var errNoConnString = errors.New("recommender: DATABASE_URL is not set, we cannot connect to the database")
+
+// Types
+
+// A meal as it's compared between users: its normalized name, so the same dish
+// served at different halls or on different days is one meal.
+type mealKey = string
+
+type recommendation struct {
+	user    int
+	meal    mealKey
+	score   float64
+	because string
+}
+
+// Functions
+
+// The main function. Runs runRecommender() and catches any errors it produces.
+func main() {
+	err := runRecommender()
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Println("Successfully computed recommendations")
+	os.Exit(0)
+}
+
+// getLikes(conn): takes a pgx database connection and returns a mapping from
+// integer user ids to the set of meals they like, along with the display name
+// of each meal. A user likes the meals in the DocCache that match their
+// preferences, and the meals they have rated likes.LIKED_RATING or higher. Returns
+// nil maps and non-nil error on failure.
+func getLikes(conn *pgx.Conn) (map[int]map[mealKey]bool, map[mealKey]string, error) {
+	userMatchers, invalid, err := likes.LoadUserMatchers(context.Background(), conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	for userId, err := range invalid {
+		log.Printf("recommender: skipping user %d with invalid preferences: %v\n", userId, err)
+	}
+
+	// The last day each user liked each meal, and each meal's name as of the
+	// last day anyone liked it. Days are YYYY-MM-DD, so they compare correctly
+	// as strings. Ties between names go to the first alphabetically, so that
+	// every run picks the same one.
+	likedOn := make(map[int]map[mealKey]string)
+	names := make(map[mealKey]string)
+	namedOn := make(map[mealKey]string)
+	like := func(userId int, name string, day string) {
+		key := matcher.Normalize(name)
+		if likedOn[userId] == nil {
+			likedOn[userId] = make(map[mealKey]string)
+		}
+		if day > likedOn[userId][key] {
+			likedOn[userId][key] = day
+		}
+		if prev, ok := names[key]; !ok || day > namedOn[key] || (day == namedOn[key] && name < prev) {
+			names[key] = name
+			namedOn[key] = day
+		}
+	}
+
+	mealRows, err := conn.Query(
+		context.Background(),
+		`SELECT meal, mealid, location, mealtime, max(day)::text
+			FROM "DocCache"
+			GROUP BY meal, mealid, location, mealtime;`,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	for mealRows.Next() {
+		var item matcher.Item
+		var day string
+		err = mealRows.Scan(&item.Name, &item.ID, &item.Location, &item.Mealtime, &day)
+		if err != nil {
+			mealRows.Close()
+			return nil, nil, err
+		}
+		for userId, userMatcher := range userMatchers {
+			if userMatcher.Match(item) {
+				like(userId, item.Name, day)
+			}
+		}
+	}
+	mealRows.Close()
+	if err = mealRows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// Ratings are by meal ID, and a meal is best known by the name it was
+	// last served under.
+	ratingRows, err := conn.Query(
+		context.Background(),
+		`SELECT "rated"."user", "named"."name", "rated"."day"::text
+			FROM (
+				SELECT "user", "mealId", max("day") AS "day"
+					FROM "Ratings"
+					WHERE "score" >= $1 AND NOT "hidden"
+					GROUP BY "user", "mealId"
+			) AS "rated"
+			JOIN LATERAL (
+				SELECT "name"
+					FROM "MealNames"
+					WHERE "MealNames"."mealId" = "rated"."mealId"
+					ORDER BY "lastSeen" DESC, "name"
+					LIMIT 1
+			) AS "named" ON true;`,
+		likes.LIKED_RATING,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	for ratingRows.Next() {
+		var userId int
+		var name, day string
+		if err = ratingRows.Scan(&userId, &name, &day); err != nil {
+			ratingRows.Close()
+			return nil, nil, err
+		}
+		like(userId, name, day)
+	}
+	ratingRows.Close()
+	if err = ratingRows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return mostRecentLikes(likedOn), names, nil
+}
+
+// mostRecentLikes(likedOn): takes a mapping from integer user ids to the last
+// day they liked each of their meals, and returns each user's
+// MAX_LIKES_PER_USER most recently liked meals as a set. Meals liked on the
+// same day are kept in alphabetical order, so the same likes always give the
+// same result.
+func mostRecentLikes(likedOn map[int]map[mealKey]string) map[int]map[mealKey]bool {
+	likes := make(map[int]map[mealKey]bool, len(likedOn))
+	for userId, days := range likedOn {
+		keys := make([]mealKey, 0, len(days))
+		for key := range days {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if days[keys[i]] != days[keys[j]] {
+				return days[keys[i]] > days[keys[j]]
+			}
+			return keys[i] < keys[j]
+		})
+		if len(keys) > MAX_LIKES_PER_USER {
+			keys = keys[:MAX_LIKES_PER_USER]
+		}
+
+		likes[userId] = make(map[mealKey]bool, len(keys))
+		for _, key := range keys {
+			likes[userId][key] = true
+		}
+	}
+	return likes
+}
+
+// recommend(likes): takes a mapping from user ids to the meals they like and
+// recommends each user meals liked by the users who like the same meals as
+// them. Meals are compared by the cosine similarity of the sets of users who
+// like them, and a meal's score for a user is the sum of its similarity to
+// every meal the user likes. Each recommendation remembers which of the user's
+// meals contributed most to it, to explain it. Also returns how many users
+// like each meal, for recommending popular meals to users with no
+// recommendations.
+func recommend(likes map[int]map[mealKey]bool) ([]recommendation, map[mealKey]int) {
+	popularity := make(map[mealKey]int)
+	together := make(map[mealKey]map[mealKey]int)
+	for _, liked := range likes {
+		for a := range liked {
+			popularity[a]++
+			if together[a] == nil {
+				together[a] = make(map[mealKey]int)
+			}
+			for b := range liked {
+				if a != b {
+					together[a][b]++
+				}
+			}
+		}
+	}
+
+	var recommendations []recommendation
+	for userId, liked := range likes {
+		scores := make(map[mealKey]float64)
+		because := make(map[mealKey]mealKey)
+		best := make(map[mealKey]float64)
+		for a := range liked {
+			for b, both := range together[a] {
+				if liked[b] {
+					continue
+				}
+				similarity := float64(both) / math.Sqrt(float64(popularity[a]*popularity[b]))
+				scores[b] += similarity
+				if similarity > best[b] {
+					best[b] = similarity
+					because[b] = a
+				}
+			}
+		}
+
+		userRecommendations := make([]recommendation, 0, len(scores))
+		for meal, score := range scores {
+			userRecommendations = append(userRecommendations, recommendation{
+				user:    userId,
+				meal:    meal,
+				score:   score,
+				because: because[meal],
+			})
+		}
+		sort.Slice(userRecommendations, func(i, j int) bool {
+			if userRecommendations[i].score != userRecommendations[j].score {
+				return userRecommendations[i].score > userRecommendations[j].score
+			}
+			return userRecommendations[i].meal < userRecommendations[j].meal
+		})
+		if len(userRecommendations) > MAX_RECOMMENDATIONS_PER_USER {
+			userRecommendations = userRecommendations[:MAX_RECOMMENDATIONS_PER_USER]
+		}
+		recommendations = append(recommendations, userRecommendations...)
+	}
+
+	return recommendations, popularity
+}
+
+// saveRecommendations(conn, likes, recommendations, popularity, names): takes a
+// pgx database connection, the meals each user likes, the recommendations for
+// every user, how many users like each meal, and the display names of meals.
+// Replaces the UserLikes, Recommendations and MealPopularity tables with them
+// in one transaction, so the backend never sees a half written set. Returns
+// non-nil error on failure.
+func saveRecommendations(conn *pgx.Conn, likes map[int]map[mealKey]bool, recommendations []recommendation, popularity map[mealKey]int, names map[mealKey]string) error {
+	// Predefining the nil error to ensure err exists
+	var err error
+
+	transaction, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	// This can be safely done since transaction.Rollback returns an error
+	// once the transaction has been closed.
+	defer func() {
+		err = transaction.Rollback(context.Background())
+		if err == pgx.ErrTxClosed {
+			err = nil
+		}
+	}()
+
+	computedAt := time.Now()
+
+	// The backend needs to know which of the likes counted in MealPopularity
+	// are the user's own.
+	if _, err = transaction.Exec(context.Background(), `DELETE FROM "UserLikes";`); err != nil {
+		return err
+	}
+	var likeRows [][]any
+	for userId, liked := range likes {
+		for meal := range liked {
+			likeRows = append(likeRows, []any{userId, meal})
+		}
+	}
+	_, err = transaction.CopyFrom(
+		context.Background(),
+		pgx.Identifier{"UserLikes"},
+		[]string{"user", "mealKey"},
+		pgx.CopyFromRows(likeRows),
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err = transaction.Exec(context.Background(), `DELETE FROM "Recommendations";`); err != nil {
+		return err
+	}
+	_, err = transaction.CopyFrom(
+		context.Background(),
+		pgx.Identifier{"Recommendations"},
+		[]string{"user", "mealKey", "score", "because", "computedAt"},
+		pgx.CopyFromSlice(len(recommendations), func(i int) ([]any, error) {
+			return []any{
+				recommendations[i].user,
+				recommendations[i].meal,
+				recommendations[i].score,
+				names[recommendations[i].because],
+				computedAt,
+			}, nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err = transaction.Exec(context.Background(), `DELETE FROM "MealPopularity";`); err != nil {
+		return err
+	}
+	var popularityRows [][]any
+	for meal, likes := range popularity {
+		popularityRows = append(popularityRows, []any{meal, names[meal], likes, computedAt})
+	}
+	_, err = transaction.CopyFrom(
+		context.Background(),
+		pgx.Identifier{"MealPopularity"},
+		[]string{"mealKey", "name", "likes", "computedAt"},
+		pgx.CopyFromRows(popularityRows),
+	)
+	if err != nil {
+		return err
+	}
+
+	return transaction.Commit(context.Background())
+}
+
+// runRecommender(): Reads the database connection URL from the environment and
+// acquires a connection. Then works out what every user likes, computes their
+// recommendations and saves them for the backend. Catches and returns any
+// errors raised along the way.
+func runRecommender() error {
+	// Pre-set the nil error for the deferred conn.Close
+	var err error
+
+	connString := os.Getenv("DATABASE_URL")
+	if connString == "" {
+		return errNoConnString
+	}
+
+	conn, err := pgx.Connect(context.Background(), connString)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = conn.Close(context.Background())
+	}()
+
+	likes, names, err := getLikes(conn)
+	if err != nil {
+		return err
+	}
+
+	recommendations, popularity := recommend(likes)
+	log.Printf("Computed %d recommendation(s) for %d user(s)\n", len(recommendations), len(likes))
+
+	return saveRecommendations(conn, likes, recommendations, popularity, names)
+}
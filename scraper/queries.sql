@@ -16,3 +16,22 @@ INSERT INTO DocCache (day, location, mealtime, meal, mealid)
 	('1999-01-08', '<ID>', '<MEALTIME NAME>', '<MEAL NAME>', '<MEAL ID>');
 	-- And so on...
 
+
+-- Record a location listed by dineoncampus, updating it if we already know it.
+INSERT INTO "Locations" ("id", "building", "name", "scraped", "updatedAt")
+	VALUES ('<ID>', '<BUILDING NAME>', '<LOCATION NAME>', true, now())
+ON CONFLICT ("id") DO UPDATE SET
+	"building"=excluded."building",
+	"name"=excluded."name",
+	"scraped"=excluded."scraped",
+	"updatedAt"=now();
+
+-- Forget locations dineoncampus no longer lists.
+DELETE FROM "Locations" WHERE NOT ("id" = ANY('{<ID>, <ID>}'));
+
+-- Record the name a meal ID was served under on a given date.
+INSERT INTO "MealNames" ("mealId", "name", "firstSeen", "lastSeen")
+	VALUES ('<MEAL ID>', '<MEAL NAME>', '1999-01-08', '1999-01-08')
+ON CONFLICT ("mealId", "name") DO UPDATE SET
+	"firstSeen"=least("MealNames"."firstSeen", excluded."firstSeen"),
+	"lastSeen"=greatest("MealNames"."lastSeen", excluded."lastSeen");
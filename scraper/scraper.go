@@ -4,13 +4,13 @@ import (
 	"context"
 	"errors"
 	"log"
-	"math/rand"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	docclient "github.com/david-callender/FoodFinder/utils/dineocclient"
+	"github.com/david-callender/FoodFinder/utils/matcher"
 
 	"github.com/jackc/pgx/v5"
 )
@@ -28,14 +28,26 @@ var hallsToScrape [6]string = [6]string{
 	"Bailey Dining Hall",
 }
 
+// The scraper isn't in a hurry, so it waits out failures for longer than the
+// client would by default rather than lose a whole run to one of them. It also
+// makes far more requests than the backend, so it paces them more slowly to
+// stay clear of rate limiting and to not overload our database.
+var dineoc *docclient.Client = docclient.NewClient(
+	docclient.WithRateLimit(docclient.RateLimit{Burst: 1, Every: 5 * time.Second}),
+	docclient.WithRetry(docclient.RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   2 * time.Second,
+		MaxDelay:    time.Minute,
+	}),
+	docclient.WithAttemptObserver(logRetry),
+)
+
 var errNoConnString error = errors.New("DATABASE_URL is not set, cannot connect to database")
 var errNoScrapeBackArg error = errors.New("-back requires an argument")
 var errNoScrapeFwArg error = errors.New("-forward requires an argument")
 
 const DEFAULT_PAST_SCRAPE int = 7
 const DEFAULT_FUTURE_SCRAPE int = 14
-const SLEEP_MIN_SECS int = 5
-const SLEEP_MAX_DIFF int = 10
 const TIME_DAY time.Duration = 24 * time.Hour
 const UMN_SITE_ID string = "61d7515eb63f1e0e970debbe"
 
@@ -51,40 +63,85 @@ func main() {
 }
 
 // NON-EXPORTED FUNCTIONS
-func getLocations(siteId string) ([]docclient.Restaurant, error) {
-	foodBuildings, err := docclient.GetFoodBuildings(siteId)
+
+// logRetry(attempt (docclient.Attempt)): logs attempts at dineoncampus
+// requests that failed and are about to be tried again.
+func logRetry(attempt docclient.Attempt) {
+	if attempt.Retrying {
+		log.Printf("attempt %d failed, retrying in %v: %v\n", attempt.Number, attempt.Wait, attempt.Err)
+	}
+}
+
+// isScraped(locationName (string)): reports whether a location is one of
+// hallsToScrape.
+func isScraped(locationName string) bool {
+	for _, name := range hallsToScrape {
+		if locationName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshLocations(conn (*pgx.Conn), siteId (string)): Takes a database
+// connection and a dineoncampus site ID. Replaces the contents of the
+// Locations table with every location currently listed for the site, and
+// returns the locations that should be scraped.
+func refreshLocations(conn *pgx.Conn, siteId string) ([]docclient.Restaurant, error) {
+	foodBuildings, err := dineoc.GetFoodBuildings(context.Background(), siteId)
 	if err != nil {
 		return nil, err
 	}
 
 	var locations []docclient.Restaurant
+	var locationIds []string
+	batch := &pgx.Batch{}
 	for _, building := range foodBuildings {
 		for _, location := range building.Locations {
-			for _, name := range hallsToScrape {
-				if location.Name == name {
-					locations = append(locations, location)
-				}
+			scraped := isScraped(location.Name)
+			if scraped {
+				locations = append(locations, location)
 			}
+			locationIds = append(locationIds, location.Id)
+			batch.Queue(
+				`INSERT INTO "Locations" ("id", "building", "name", "scraped", "updatedAt")
+					VALUES ($1, $2, $3, $4, now())
+				ON CONFLICT ("id") DO UPDATE SET
+					"building"=excluded."building",
+					"name"=excluded."name",
+					"scraped"=excluded."scraped",
+					"updatedAt"=now()`,
+				location.Id, building.Name, location.Name, scraped,
+			)
 		}
 	}
 
+	// An empty listing is more likely a dineoncampus hiccup than every
+	// location closing, so we keep what we had.
+	if len(locationIds) == 0 {
+		return locations, nil
+	}
+
+	batch.Queue(`DELETE FROM "Locations" WHERE NOT ("id" = ANY($1))`, locationIds)
+
+	// Batches run in an implicit transaction, so clients never see a
+	// partially refreshed table.
+	if err := conn.SendBatch(context.Background(), batch).Close(); err != nil {
+		return nil, err
+	}
+
 	return locations, nil
 }
 
-// scrapeMenuToDatabase(conn (*pgx.Conn), locationId, periodName (strings), date (time.Time):
+// scrapeMenuToDatabase(conn (*pgx.Conn), locationId, periodName (strings), date (time.Time), menu (docclient.Menu)):
 // Takes a database connection, a dineoncampus location ID, a meal period name,
-// and a date. It removes all old menu data for the menu corresponding to these
-// parameters, and fills in new menu data if it exists.
-func scrapeMenuToDatabase(conn *pgx.Conn, locationId, periodName string, date time.Time) error {
+// a date, and the menu fetched for them. It removes all old menu data for the
+// menu corresponding to these parameters, and fills in the new menu data if
+// there is any.
+func scrapeMenuToDatabase(conn *pgx.Conn, locationId, periodName string, date time.Time, menu docclient.Menu) error {
 	// Predefining the nil error to ensure err exists
 	var err error
 
-	// Fetch the menu data for insertion into the DB
-	menu, err := docclient.GetMenuById(locationId, periodName, date)
-	if err != nil {
-		return err
-	}
-
 	// Convert periodName to a 16-bit integer identifier as used in our db.
 	// Int16 to avoid type issues because mealtime is a smallint in our db.
 	var mealtimeNum int16 = 255 // 255 stands in for our uninitialized value.
@@ -144,6 +201,33 @@ func scrapeMenuToDatabase(conn *pgx.Conn, locationId, periodName string, date ti
 		if err != nil {
 			return err
 		}
+
+		// Record the names the meals went by today so that favorites by
+		// meal ID can still be shown by name once this menu is pruned.
+		// Each name is stored with its matcher.Normalize form as well, so
+		// that the backend can look names up the same way preferences match.
+		var mealIds, mealNames, nameKeys []string
+		for _, meal := range menu.Options {
+			if meal.Id != "" {
+				mealIds = append(mealIds, meal.Id)
+				mealNames = append(mealNames, meal.Name)
+				nameKeys = append(nameKeys, matcher.Normalize(meal.Name))
+			}
+		}
+		_, err = transaction.Exec(
+			context.Background(),
+			`INSERT INTO "MealNames" ("mealId", "name", "nameKey", "firstSeen", "lastSeen")
+				SELECT DISTINCT "id", "name", "key", $4::date, $4::date
+					FROM unnest($1::text[], $2::text[], $3::text[]) AS "meals" ("id", "name", "key")
+			ON CONFLICT ("mealId", "name") DO UPDATE SET
+				"nameKey"=excluded."nameKey",
+				"firstSeen"=least("MealNames"."firstSeen", excluded."firstSeen"),
+				"lastSeen"=greatest("MealNames"."lastSeen", excluded."lastSeen")`,
+			mealIds, mealNames, nameKeys, dateFormatted,
+		)
+		if err != nil {
+			return err
+		}
 	}
 
 	if err := transaction.Commit(context.Background()); err != nil {
@@ -215,8 +299,8 @@ func runScraper() error {
 // Takes a database connection, a dineoncampus site ID, and a list of dates to scrape.
 // Will scrape all available menus for the given days into the database.
 func ScrapeMenusToDatabase(conn *pgx.Conn, dates []time.Time, siteId string) error {
-	// Fetch all food locations at a given site
-	locations, err := getLocations(siteId)
+	// Fetch all food locations at a given site, recording them in the db
+	locations, err := refreshLocations(conn, siteId)
 	if err != nil {
 		return err
 	}
@@ -233,17 +317,38 @@ func ScrapeMenusToDatabase(conn *pgx.Conn, dates []time.Time, siteId string) err
 	}
 
 	for _, location := range locations {
-		for _, periodName := range mealtimeIndexer {
-			for _, date := range dates {
-				err = scrapeMenuToDatabase(conn, location.Id, periodName, date)
+		for _, date := range dates {
+			// All of a day's menus are fetched together so that its periods
+			// are only asked for once.
+			dayMenus, periodErrs, err := dineoc.GetDayMenus(context.Background(), location.Id, date)
+			if errors.Is(err, docclient.ErrNotFound) {
+				// Not every location has menus every day, so a missing day is
+				// skipped. Anything else, such as still being rate limited
+				// after retrying, stops the scrape.
+				log.Printf("no menus for %s on %s, skipping", location.Name, date.Format("2006-01-02"))
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			// Periods that aren't served that day, which GetDayMenus leaves
+			// out of both maps, get an empty menu, which clears out anything
+			// scraped for them before. A period listed
+			// without a menu keeps what was scraped for it, since that is
+			// more likely a hiccup on dineoncampus' end than a change.
+			for _, periodName := range mealtimeIndexer {
+				if periodErr, ok := periodErrs[periodName]; ok {
+					if !errors.Is(periodErr, docclient.ErrNotFound) {
+						return periodErr
+					}
+					log.Printf("no %s menu for %s on %s, skipping", periodName, location.Name, date.Format("2006-01-02"))
+					continue
+				}
+
+				err = scrapeMenuToDatabase(conn, location.Id, periodName, date, dayMenus[periodName])
 				if err != nil {
 					return err
 				}
-				// We sleep between SLEEP_MIN_SECS and
-				// SLEEP_MAX_DIFF + SLEEP_MIN_SECS seconds
-				// to prevent rate limiting or overloading
-				// our database when scraping.
-				time.Sleep(time.Duration(rand.Intn(SLEEP_MAX_DIFF)+SLEEP_MIN_SECS) * time.Second)
 			}
 		}
 	}
@@ -0,0 +1,88 @@
+package dineocclient
+
+import (
+	"sync"
+	"time"
+)
+
+// EXPORTED FUNCTIONS: MAY BE USED BY IMPORTING MODULES
+
+// WithPeriodCache(ttl): makes the client remember the meal periods of a
+// location on a date for ttl, so fetching several of that day's menus only
+// asks dineoncampus for its periods once. Periods rarely change, but a short
+// ttl keeps a change from going unnoticed for long. Zero turns the cache off,
+// which is the default.
+func WithPeriodCache(ttl time.Duration) Option {
+	return func(c *Client) {
+		if ttl <= 0 {
+			c.periods = nil
+			return
+		}
+		c.periods = &periodCache{ttl: ttl, entries: map[periodKey]periodEntry{}}
+	}
+}
+
+// NON-EXPORTED TYPES
+
+// periodCache remembers the periods of a location on a date. A nil
+// *periodCache is an empty cache that never remembers anything.
+type periodCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[periodKey]periodEntry
+}
+
+type periodKey struct {
+	locationId, date string
+}
+
+type periodEntry struct {
+	periodIds periodIdSpec
+	expiresAt time.Time
+}
+
+// NON-EXPORTED FUNCTIONS: MAY NOT BE USED BY IMPORTING MODULES
+
+// (*periodCache) get(locationId, date): returns the remembered periods of
+// locationId on date, if there are any that haven't expired.
+func (p *periodCache) get(locationId, date string) (periodIdSpec, bool) {
+	if p == nil {
+		return periodIdSpec{}, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[periodKey{locationId, date}]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return periodIdSpec{}, false
+	}
+	return entry.periodIds, true
+}
+
+// (*periodCache) put(locationId, date, periodIds): remembers the periods of
+// locationId on date for the cache's ttl.
+func (p *periodCache) put(locationId, date string, periodIds periodIdSpec) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+
+	// Expired entries are dropped whenever one is added, so the map only
+	// ever holds about a ttl's worth of them.
+	for key, entry := range p.entries {
+		if now.After(entry.expiresAt) {
+			delete(p.entries, key)
+		}
+	}
+
+	p.entries[periodKey{locationId, date}] = periodEntry{
+		periodIds: periodIds,
+		expiresAt: now.Add(p.ttl),
+	}
+}
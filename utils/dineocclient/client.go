@@ -0,0 +1,126 @@
+package dineocclient
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long a request may take, including reading the body, unless the client
+// is given another timeout or http.Client.
+const DEFAULT_TIMEOUT = 30 * time.Second
+
+// EXPORTED TYPES: MAY BE USED BY IMPORTING MODULES
+
+// Client makes requests to the dineoncampus api. Its methods are safe for
+// concurrent use. The zero value is not usable, create one with NewClient.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	userAgent  UserAgentFunc
+	logger     Logger
+	retry      RetryPolicy
+	observer   AttemptObserver
+	limiter    *hostLimiter
+	periods    *periodCache
+}
+
+// Option configures a Client in NewClient.
+type Option func(*Client)
+
+// UserAgentFunc picks the user agent to send with a request.
+type UserAgentFunc func() string
+
+// Logger is anything that can log a formatted line, such as a *log.Logger.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// NON-EXPORTED VARIABLES
+
+// The client used by the package-level functions.
+var defaultClient = NewClient()
+
+// EXPORTED FUNCTIONS: MAY BE USED BY IMPORTING MODULES
+
+// NewClient(opts): returns a Client talking to the real dineoncampus api with
+// DEFAULT_TIMEOUT, DEFAULT_RETRY_POLICY, DEFAULT_RATE_LIMIT and a random
+// browser user agent per request, changed by any opts given.
+func NewClient(opts ...Option) *Client {
+	client := &Client{
+		baseURL:    dineocaddress,
+		httpClient: http.DefaultClient,
+		timeout:    DEFAULT_TIMEOUT,
+		userAgent:  RandomUserAgent,
+		retry:      DEFAULT_RETRY_POLICY,
+		limiter:    newHostLimiter(),
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+
+	// The timeout is applied to a copy so that the caller's http.Client
+	// isn't changed under them.
+	if client.timeout != 0 {
+		httpClient := *client.httpClient
+		httpClient.Timeout = client.timeout
+		client.httpClient = &httpClient
+	}
+
+	return client
+}
+
+// WithBaseURL(baseURL): makes the client send requests to baseURL instead of
+// the dineoncampus api, such as an httptest.Server's URL.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/") + "/"
+	}
+}
+
+// WithHTTPClient(httpClient): makes the client send requests with httpClient.
+// The client's timeout still applies unless WithTimeout(0) is also given.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout(timeout): sets how long a request may take. Zero leaves the
+// http.Client's own timeout alone.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithUserAgent(userAgent): makes the client ask userAgent for the user agent
+// of each request.
+func WithUserAgent(userAgent UserAgentFunc) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithLogger(logger): makes the client log every request it makes to logger.
+func WithLogger(logger Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// RandomUserAgent(): returns one of a set of common browser user agents at
+// random. Cloudflare tends to block requests with unusual user agents.
+func RandomUserAgent() string {
+	return useragents[rand.Intn(len(useragents))]
+}
+
+// FixedUserAgent(userAgent): returns a UserAgentFunc that always uses
+// userAgent.
+func FixedUserAgent(userAgent string) UserAgentFunc {
+	return func() string {
+		return userAgent
+	}
+}
@@ -0,0 +1,189 @@
+package dineocclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient(t, handler): returns a Client talking to an httptest.Server
+// running handler, with retries and rate limiting off so tests don't wait.
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	opts = append([]Option{
+		WithBaseURL(server.URL),
+		WithRetry(RetryPolicy{}),
+		WithRateLimit(RateLimit{}),
+	}, opts...)
+	return NewClient(opts...)
+}
+
+func TestClientGetFoodBuildings(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sites/site/locations-public" {
+			t.Errorf("request to %s, want /sites/site/locations-public", r.URL.Path)
+		}
+		if got := r.Header.Get("User-Agent"); got != "test-agent" {
+			t.Errorf("User-Agent = %q, want test-agent", got)
+		}
+		w.Write([]byte(`{"buildings": [{"buildingName": "Comstock", "locations": []}]}`))
+	}, WithUserAgent(FixedUserAgent("test-agent")))
+
+	buildings, err := client.GetFoodBuildings(context.Background(), "site")
+	if err != nil {
+		t.Fatalf("GetFoodBuildings: %v", err)
+	}
+	if len(buildings) != 1 || buildings[0].Name != "Comstock" {
+		t.Errorf("GetFoodBuildings = %+v, want one building named Comstock", buildings)
+	}
+}
+
+func TestClientUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		is     error
+		isNot  []error
+	}{
+		{http.StatusForbidden, ErrBlocked, []error{ErrNotFound, ErrRateLimited}},
+		{http.StatusNotFound, ErrNotFound, []error{ErrBlocked, ErrRateLimited}},
+		{http.StatusTooManyRequests, ErrRateLimited, []error{ErrBlocked, ErrNotFound}},
+		{http.StatusInternalServerError, ErrUpstream, []error{ErrBlocked, ErrNotFound, ErrRateLimited}},
+		{http.StatusBadGateway, ErrUpstream, []error{ErrBlocked, ErrNotFound, ErrRateLimited}},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "7")
+				w.WriteHeader(test.status)
+				w.Write([]byte("<html>\n  <body>Go   away</body>\n</html>"))
+			})
+
+			_, err := client.GetFoodBuildings(context.Background(), "site")
+			if !errors.Is(err, test.is) {
+				t.Errorf("error %v is not %v", err, test.is)
+			}
+			if !errors.Is(err, ErrUpstream) {
+				t.Errorf("error %v is not ErrUpstream", err)
+			}
+			for _, target := range test.isNot {
+				if errors.Is(err, target) {
+					t.Errorf("error %v is %v", err, target)
+				}
+			}
+
+			var upstreamErr *UpstreamError
+			if !errors.As(err, &upstreamErr) {
+				t.Fatalf("error %v is not an *UpstreamError", err)
+			}
+			if upstreamErr.StatusCode != test.status {
+				t.Errorf("StatusCode = %d, want %d", upstreamErr.StatusCode, test.status)
+			}
+			if !strings.HasSuffix(upstreamErr.URL, "/sites/site/locations-public?for_menus=true") {
+				t.Errorf("URL = %q, want the request's URL", upstreamErr.URL)
+			}
+			if want := "<html> <body>Go away</body> </html>"; upstreamErr.Snippet != want {
+				t.Errorf("Snippet = %q, want %q", upstreamErr.Snippet, want)
+			}
+			if upstreamErr.RetryAfter != 7*time.Second {
+				t.Errorf("RetryAfter = %v, want 7s", upstreamErr.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestClientErrorSnippetIsTruncated(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(strings.Repeat("x", ERROR_SNIPPET_LENGTH*10)))
+	})
+
+	_, err := client.GetFoodBuildings(context.Background(), "site")
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		t.Fatalf("error %v is not an *UpstreamError", err)
+	}
+	if len(upstreamErr.Snippet) != ERROR_SNIPPET_LENGTH {
+		t.Errorf("len(Snippet) = %d, want %d", len(upstreamErr.Snippet), ERROR_SNIPPET_LENGTH)
+	}
+	if upstreamErr.RetryAfter != 0 {
+		t.Errorf("RetryAfter = %v without a Retry-After header, want 0", upstreamErr.RetryAfter)
+	}
+}
+
+func TestClientLocationNotFound(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"buildings": [{"buildingName": "Comstock", "locations": [{"id": "l1", "name": "Dining Hall"}]}]}`))
+	})
+
+	_, err := client.GetLocationIdByName(context.Background(), "Comstock", "Food Court", "site")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetLocationIdByName = %v, want ErrNotFound", err)
+	}
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		t.Errorf("GetLocationIdByName = %v, want an error not from dineoncampus", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}, WithTimeout(10*time.Millisecond))
+
+	_, err := client.GetFoodBuildings(context.Background(), "site")
+	if err == nil {
+		t.Fatal("GetFoodBuildings succeeded, want a timeout")
+	}
+	if errors.Is(err, ErrUpstream) {
+		t.Errorf("GetFoodBuildings = %v, want an error not from dineoncampus", err)
+	}
+	if !isRetryable(err) {
+		t.Errorf("timeout %v isn't retryable", err)
+	}
+}
+
+func TestClientGetDayMenusKeepsGoodPeriods(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/periods") {
+			w.Write([]byte(`{"periods": [{"id": "p1", "name": "Breakfast"}, {"id": "p2", "name": "Lunch"}, {"id": "p3", "name": "Dinner"}]}`))
+			return
+		}
+		switch r.URL.Query().Get("period") {
+		case "p2":
+			w.WriteHeader(http.StatusNotFound)
+		case "p3":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.Write([]byte(`{"period": {"name": "Breakfast", "categories": [{"items": [{"id": "m1", "name": "Oatmeal"}]}]}}`))
+		}
+	})
+
+	menus, periodErrs, err := client.GetDayMenus(context.Background(), "location", time.Now())
+	if err != nil {
+		t.Fatalf("GetDayMenus: %v", err)
+	}
+	if len(menus) != 1 || len(menus["breakfast"].Options) != 1 {
+		t.Errorf("GetDayMenus menus = %+v, want only breakfast", menus)
+	}
+	if len(periodErrs) != 2 || !errors.Is(periodErrs["lunch"], ErrNotFound) || !errors.Is(periodErrs["dinner"], ErrBlocked) {
+		t.Errorf("GetDayMenus period errors = %v, want lunch not found and dinner blocked", periodErrs)
+	}
+	// No "Every Day" period was listed, so it wasn't served.
+	_, hasMenu := menus["everyday"]
+	_, hasErr := periodErrs["everyday"]
+	if hasMenu || hasErr {
+		t.Errorf("GetDayMenus returned a period that wasn't served")
+	}
+}
@@ -1,16 +1,17 @@
 package dineocclient
 
 import (
+	"context"
 	jsonv2 "encoding/json/v2"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
 	"strings"
 	"time"
 )
 
 // Global config variables that we ought to move out to a config file
+// The base URL clients use unless given another with WithBaseURL.
 const dineocaddress = "https://apiv4.dineoncampus.com/"
 
 // EXPORTED TYPES: MAY BE USED BY IMPORTING MODULES
@@ -39,7 +40,7 @@ type Restaurant struct {
 
 // NON-EXPORTED TYPES: MAY NOT BE USED BY IMPORTING MODULES
 
-// Internal struct used for passing one-time use period IDs
+// Internal struct used for passing the period IDs of a location on a day
 type periodIdSpec struct {
 	Breakfast, Dinner, Lunch, Everyday string
 }
@@ -78,12 +79,61 @@ type menuPeriod struct {
 
 // GetFoodBuildings(site string): Takes a dineoncampus site id and returns a
 // slice of FoodLocation structs representing all food locations found for
-// the site.
+// the site. Uses the default client.
 func GetFoodBuildings(siteId string) ([]FoodBuilding, error) {
-	apifunc := dineocaddress +
+	return defaultClient.GetFoodBuildings(context.Background(), siteId)
+}
+
+// GetLocationIdByName(buildingName, locationName): Takes the name of a building,
+// the name of a location, and a dineoncampus site ID, and returns the location
+// ID corresponding to that location. Names are case-insensitive. Uses the
+// default client.
+func GetLocationIdByName(buildingName, locationName, siteId string) (string, error) {
+	return defaultClient.GetLocationIdByName(context.Background(), buildingName, locationName, siteId)
+}
+
+// GetMenuByName(buildingName, locationName, periodName, site (strings), date (time)):
+// Takes the name of a building, the name of a location within the building,
+// a named meal period ("breakfast", "lunch", "dinner", or "everyday"), a
+// dineoncampus site ID, and a time.Time representing the date for the menu requested.
+// Returns a Menu populated with the options from dineoncampus. Names are
+// case-insensitive. Uses the default client.
+func GetMenuByName(buildingName, locationName, periodName, siteId string, date time.Time) (Menu, error) {
+	return defaultClient.GetMenuByName(context.Background(), buildingName, locationName, periodName, siteId, date)
+}
+
+// GetMenuById(locationId, periodName (strings), date (time.Time)): Takes the
+// ID of a food location (NOT A BUILDING ID), a named meal period, and a time.Time
+// representing a calendar date. Returns a Menu populated with the options from
+// dineoncampus. Uses the default client.
+func GetMenuById(locationId, periodName string, date time.Time) (Menu, error) {
+	return defaultClient.GetMenuById(context.Background(), locationId, periodName, date)
+}
+
+// GetDayMenus(locationId (string), date (time.Time)): Takes the ID of a food
+// location and a time.Time representing a calendar date. Returns the menus of
+// every meal period served there that day, keyed by period name ("breakfast",
+// "lunch", "dinner", or "everyday"), fetching the day's periods only once. A
+// period whose menu can't be fetched is instead in the second map, keyed the
+// same way, with its error, so that one bad period doesn't lose the rest of
+// the day. Every period is in at most one of the maps, and one that is in
+// neither was not served there that day; callers may rely on this to clear
+// out menus they have stored for it. The error is only non-nil, with both
+// maps nil, if the day's periods can't be fetched at all. Uses the default
+// client.
+func GetDayMenus(locationId string, date time.Time) (map[string]Menu, map[string]error, error) {
+	return defaultClient.GetDayMenus(context.Background(), locationId, date)
+}
+
+// EXPORTED METHODS: MAY BE USED BY IMPORTING MODULES
+
+// (*Client) GetFoodBuildings(ctx, siteId): like GetFoodBuildings, but
+// canceled along with ctx.
+func (c *Client) GetFoodBuildings(ctx context.Context, siteId string) ([]FoodBuilding, error) {
+	apifunc := c.baseURL +
 		"sites/" + siteId +
 		"/locations-public?for_menus=true"
-	jsonData, err := makeDineocApiCall(apifunc)
+	jsonData, err := c.makeDineocApiCall(ctx, apifunc)
 	if err != nil {
 		return nil, err
 	}
@@ -100,16 +150,15 @@ func GetFoodBuildings(siteId string) ([]FoodBuilding, error) {
 	return buildings.Buildings, nil
 }
 
-// GetLocationIdByName(buildingName, locationName): Takes the name of a building,
-// the name of a location, and a dineoncampus site ID, and returns the location
-// ID corresponding to that location. Names are case-insensitive
-func GetLocationIdByName(buildingName, locationName, siteId string) (string, error) {
+// (*Client) GetLocationIdByName(ctx, buildingName, locationName, siteId): like
+// GetLocationIdByName, but canceled along with ctx.
+func (c *Client) GetLocationIdByName(ctx context.Context, buildingName, locationName, siteId string) (string, error) {
 	var locationId string
 
 	buildingName = strings.ToLower(buildingName)
 	locationName = strings.ToLower(locationName)
 
-	buildings, err := GetFoodBuildings(siteId)
+	buildings, err := c.GetFoodBuildings(ctx, siteId)
 	if err != nil {
 		return "", err
 	}
@@ -127,38 +176,31 @@ func GetLocationIdByName(buildingName, locationName, siteId string) (string, err
 	}
 
 	if locationId == "" {
-		err := fmt.Errorf("GetLocationIdByName(): Could not find location: %v", locationName)
+		err := fmt.Errorf("GetLocationIdByName(): Could not find location: %v: %w", locationName, ErrNotFound)
 		return "", err
 	}
 
 	return locationId, nil
 }
 
-// GetMenuByName(buildingName, locationName, periodName, site (strings), date (time)):
-// Takes the name of a building, the name of a location within the building,
-// a named meal period ("breakfast", "lunch", "dinner", or "everyday"), a
-// dineoncampus site ID, and a time.Time representing the date for the menu requested.
-// Returns a Menu populated with the options from dineoncampus. Names are
-// case-insensitive.
-func GetMenuByName(buildingName, locationName, periodName, siteId string, date time.Time) (Menu, error) {
-	locationId, err := GetLocationIdByName(buildingName, locationName, siteId)
+// (*Client) GetMenuByName(ctx, buildingName, locationName, periodName, siteId, date):
+// like GetMenuByName, but canceled along with ctx.
+func (c *Client) GetMenuByName(ctx context.Context, buildingName, locationName, periodName, siteId string, date time.Time) (Menu, error) {
+	locationId, err := c.GetLocationIdByName(ctx, buildingName, locationName, siteId)
 	if err != nil {
 		return Menu{}, err
 	}
 
-	return GetMenuById(locationId, periodName, date)
+	return c.GetMenuById(ctx, locationId, periodName, date)
 }
 
-// GetMenuById(locationId, periodName (strings), date (time.Time)): Takes the
-// ID of a food location (NOT A BUILDING ID), a named meal period, and a time.Time
-// representing a calendar date. Returns a Menu populated with the options from
-// dineoncampus.
-func GetMenuById(locationId, periodName string, date time.Time) (Menu, error) {
+// (*Client) GetMenuById(ctx, locationId, periodName, date): like GetMenuById,
+// but canceled along with ctx.
+func (c *Client) GetMenuById(ctx context.Context, locationId, periodName string, date time.Time) (Menu, error) {
 	menu := Menu{Options: []Meal{}}
 	var periodId string
 
-	dateFormatted := date.Format("2006-01-02")
-	periodIds, err := getPeriodIds(locationId, date)
+	periodIds, err := c.getPeriodIds(ctx, locationId, date)
 	if err != nil {
 		return menu, err
 	}
@@ -181,11 +223,55 @@ func GetMenuById(locationId, periodName string, date time.Time) (Menu, error) {
 		return menu, nil
 	}
 
-	apifunc := dineocaddress +
+	return c.getMenuByPeriodId(ctx, locationId, periodId, date)
+}
+
+// (*Client) GetDayMenus(ctx, locationId, date): like GetDayMenus, but canceled
+// along with ctx. A period canceled along with ctx is in the map of errors,
+// not left out.
+func (c *Client) GetDayMenus(ctx context.Context, locationId string, date time.Time) (map[string]Menu, map[string]error, error) {
+	periodIds, err := c.getPeriodIds(ctx, locationId, date)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	menus := make(map[string]Menu, 4)
+	periodErrs := make(map[string]error)
+	for _, period := range []struct{ name, id string }{
+		{"breakfast", periodIds.Breakfast},
+		{"lunch", periodIds.Lunch},
+		{"dinner", periodIds.Dinner},
+		{"everyday", periodIds.Everyday},
+	} {
+		if period.id == "" {
+			continue
+		}
+
+		menu, err := c.getMenuByPeriodId(ctx, locationId, period.id, date)
+		if err != nil {
+			periodErrs[period.name] = err
+			continue
+		}
+		menus[period.name] = menu
+	}
+
+	return menus, periodErrs, nil
+}
+
+// NON-EXPORTED FUNCTIONS: MAY NOT BE USED BY IMPORTING MODULES
+
+// (*Client) getMenuByPeriodId(ctx, locationId, periodId, date): takes a dining
+// hall location ID and the ID of one of its meal periods on date, and returns
+// the Menu for that period.
+func (c *Client) getMenuByPeriodId(ctx context.Context, locationId, periodId string, date time.Time) (Menu, error) {
+	menu := Menu{Options: []Meal{}}
+
+	dateFormatted := date.Format("2006-01-02")
+	apifunc := c.baseURL +
 		"locations/" + locationId +
 		"/menu?date=" + dateFormatted +
 		"&period=" + periodId
-	jsonData, err := makeDineocApiCall(apifunc)
+	jsonData, err := c.makeDineocApiCall(ctx, apifunc)
 	if err != nil {
 		return menu, err
 	}
@@ -214,20 +300,23 @@ func GetMenuById(locationId, periodName string, date time.Time) (Menu, error) {
 	return menu, nil
 }
 
-// NON-EXPORTED FUNCTIONS: MAY NOT BE USED BY IMPORTING MODULES
-
-// getPeriodIds(locationId, date): takes a dining hall location ID and returns
-// a periodIdSpec containing a set of meal period IDs for breakfast, lunch,
-// dinner, and everyday menus. These IDs may only be used once each.
-func getPeriodIds(locationId string, date time.Time) (periodIdSpec, error) {
+// (*Client) getPeriodIds(ctx, locationId, date): takes a dining hall location
+// ID and returns a periodIdSpec containing a set of meal period IDs for
+// breakfast, lunch, dinner, and everyday menus. The IDs come from the client's
+// period cache if it has one and they are in it.
+func (c *Client) getPeriodIds(ctx context.Context, locationId string, date time.Time) (periodIdSpec, error) {
 	// This has to be defined up here in case of an error so we have a 0 value
 	var periodIds periodIdSpec
 
 	dateFormatted := date.Format("2006-01-02")
-	apifunc := dineocaddress +
+	if periodIds, ok := c.periods.get(locationId, dateFormatted); ok {
+		return periodIds, nil
+	}
+
+	apifunc := c.baseURL +
 		"locations/" + locationId +
 		"/periods/?date=" + dateFormatted
-	jsonData, err := makeDineocApiCall(apifunc)
+	jsonData, err := c.makeDineocApiCall(ctx, apifunc)
 	if err != nil {
 		return periodIds, err
 	}
@@ -259,49 +348,100 @@ func getPeriodIds(locationId string, date time.Time) (periodIdSpec, error) {
 		}
 	}
 
+	c.periods.put(locationId, dateFormatted, periodIds)
 	return periodIds, nil
 }
 
-// makeDineocApiCall(apiurl): make a GET request to apiurl, and return the
-// body of the response.
-func makeDineocApiCall(apiurl string) ([]byte, error) {
-	// Defining the nil error ahead of time so we may catch errors from
-	// the deferred function.
-	var err error
-	req, err := newDineocApiRequest(apiurl, "GET")
+// (*Client) makeDineocApiCall(ctx, apiurl): make a GET request to apiurl,
+// retrying it according to the client's retry policy, and return the body of
+// the response. Returns an *UpstreamError if the last response isn't a 2xx.
+func (c *Client) makeDineocApiCall(ctx context.Context, apiurl string) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		body, err := c.tryDineocApiCall(ctx, apiurl)
+
+		var retrying bool
+		var wait time.Duration
+		// Once ctx is done every further attempt would fail straight away.
+		if err != nil && ctx.Err() == nil {
+			retrying, wait = c.retry.delay(attempt, err)
+		}
+
+		if c.observer != nil {
+			c.observer(Attempt{URL: apiurl, Number: attempt, Err: err, Retrying: retrying, Wait: wait})
+		}
+		if !retrying {
+			return body, err
+		}
+
+		if c.logger != nil {
+			c.logger.Printf("dineocclient: GET %s: retrying in %v after attempt %d: %v", apiurl, wait, attempt, err)
+		}
+		if sleepErr := sleep(ctx, wait); sleepErr != nil {
+			return nil, err
+		}
+	}
+}
+
+// (*Client) tryDineocApiCall(ctx, apiurl): make a single GET request to
+// apiurl once the client's rate limit allows it, and return the body of the
+// response. Returns an *UpstreamError if the response isn't a 2xx.
+func (c *Client) tryDineocApiCall(ctx context.Context, apiurl string) (body []byte, err error) {
+	req, err := c.newDineocApiRequest(ctx, apiurl, "GET")
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	if err = c.limiter.wait(ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		if c.logger != nil {
+			c.logger.Printf("dineocclient: GET %s failed: %v", apiurl, err)
+		}
 		return nil, err
 	}
+	if c.logger != nil {
+		c.logger.Printf("dineocclient: GET %s: %s in %v", apiurl, resp.Status, time.Since(start))
+	}
+	// err is a named result so that a failure to close the body isn't lost,
+	// though it doesn't replace an earlier error.
 	defer func() {
-		err = resp.Body.Close()
+		if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
+			body, err = nil, closeErr
+		}
 	}()
 
-	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Only the start of the body goes in the error, so there's no
+		// point reading all of what might be a large HTML page.
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, ERROR_SNIPPET_LENGTH*4))
+		return nil, newUpstreamError(apiurl, resp, snippet)
+	}
+
+	body, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	return body, err
+	return body, nil
 }
 
-// newDineocApiRequest(apiurl, method): return a http request to the given apiurl
-// with properly populated headers for making a request to the dineoc api.
-func newDineocApiRequest(apiurl string, method string) (*http.Request, error) {
-	req, err := http.NewRequest("GET", apiurl, nil)
+// (*Client) newDineocApiRequest(ctx, apiurl, method): return a http request
+// to the given apiurl with properly populated headers for making a request to
+// the dineoc api.
+func (c *Client) newDineocApiRequest(ctx context.Context, apiurl string, method string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, apiurl, nil)
 	if err != nil {
 		return nil, err
 	}
 	// We have to add some minimum of headers to ensure that we get the right
 	// data, and also to make sure that the client does not get blocked by
 	// cloudflare (typically due to a bad useragent).
-	req.Header.Add("user-agent", useragents[rand.Intn(len(useragents))])
+	req.Header.Add("user-agent", c.userAgent())
 	req.Header.Add("accept", "application/json")
 	// req is already a pointer because http.newRequest returns a pointer
 	return req, nil
@@ -0,0 +1,85 @@
+package dineocclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How much of an error response's body is kept in an UpstreamError.
+const ERROR_SNIPPET_LENGTH = 256
+
+// EXPORTED ERRORS: MAY BE CHECKED FOR BY IMPORTING MODULES WITH errors.Is
+
+// Every request dineoncampus answers with a status other than 2xx fails with
+// an *UpstreamError, which is ErrUpstream. Some statuses also make it one of
+// the more specific errors below.
+var ErrUpstream = errors.New("dineocclient: dineoncampus returned an error")
+
+// dineoncampus answered 429, asking us to slow down.
+var ErrRateLimited = errors.New("dineocclient: rate limited by dineoncampus")
+
+// dineoncampus (or rather Cloudflare in front of it) answered 403, which
+// usually means it doesn't like our user agent or our request rate.
+var ErrBlocked = errors.New("dineocclient: blocked by dineoncampus")
+
+// dineoncampus answered 404, such as for an unknown site or location ID.
+var ErrNotFound = errors.New("dineocclient: not found on dineoncampus")
+
+// The client's own rate limit would have held a request past its context's
+// deadline, so it was never sent.
+var ErrRateLimitWait = errors.New("dineocclient: rate limit wait would exceed the deadline")
+
+// EXPORTED TYPES: MAY BE USED BY IMPORTING MODULES
+
+// UpstreamError is a request dineoncampus answered with a status other than
+// 2xx. Snippet is the start of the response body, which is often an HTML page
+// explaining the error. RetryAfter is how long the response's Retry-After
+// header asked us to wait, or 0 if it didn't have one.
+type UpstreamError struct {
+	URL        string
+	StatusCode int
+	Snippet    string
+	RetryAfter time.Duration
+}
+
+// (*UpstreamError) Error(): describes the error.
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("dineocclient: GET %s: %d %s: %q", e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Snippet)
+}
+
+// (*UpstreamError) Is(target): reports whether the error is ErrUpstream, or
+// the more specific error its status code stands for.
+func (e *UpstreamError) Is(target error) bool {
+	switch target {
+	case ErrUpstream:
+		return true
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrBlocked:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// NON-EXPORTED FUNCTIONS: MAY NOT BE USED BY IMPORTING MODULES
+
+// newUpstreamError(apiurl, resp, body): returns an *UpstreamError for a
+// response, keeping the first ERROR_SNIPPET_LENGTH bytes of the body with
+// whitespace collapsed.
+func newUpstreamError(apiurl string, resp *http.Response, body []byte) *UpstreamError {
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	if len(snippet) > ERROR_SNIPPET_LENGTH {
+		snippet = snippet[:ERROR_SNIPPET_LENGTH]
+	}
+	return &UpstreamError{
+		URL:        apiurl,
+		StatusCode: resp.StatusCode,
+		Snippet:    snippet,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
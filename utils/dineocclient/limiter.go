@@ -0,0 +1,124 @@
+package dineocclient
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The rate limit clients use for every host unless given another with
+// WithRateLimit or WithHostRateLimit.
+var DEFAULT_RATE_LIMIT = RateLimit{Burst: 4, Every: 2 * time.Second}
+
+// EXPORTED TYPES: MAY BE USED BY IMPORTING MODULES
+
+// RateLimit is a token bucket budget for requests to a host. The bucket holds
+// up to Burst requests and gets one back every Every. A zero Every means
+// requests to the host aren't limited.
+type RateLimit struct {
+	Burst int
+	Every time.Duration
+}
+
+// EXPORTED FUNCTIONS: MAY BE USED BY IMPORTING MODULES
+
+// WithRateLimit(limit): limits requests to every host that doesn't have its
+// own limit from WithHostRateLimit. WithRateLimit(RateLimit{}) turns the
+// limit off.
+func WithRateLimit(limit RateLimit) Option {
+	return func(c *Client) {
+		c.limiter.defaultLimit = limit
+	}
+}
+
+// WithHostRateLimit(host, limit): limits requests to host, such as
+// "apiv4.dineoncampus.com", to limit.
+func WithHostRateLimit(host string, limit RateLimit) Option {
+	return func(c *Client) {
+		c.limiter.limits[host] = limit
+	}
+}
+
+// NON-EXPORTED TYPES
+
+// hostLimiter keeps a token bucket per host. It is shared by everything using
+// the client it belongs to, so the limit holds however many goroutines make
+// requests at once.
+type hostLimiter struct {
+	defaultLimit RateLimit
+	limits       map[string]RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// NON-EXPORTED FUNCTIONS: MAY NOT BE USED BY IMPORTING MODULES
+
+// newHostLimiter(): returns a hostLimiter with DEFAULT_RATE_LIMIT for every
+// host.
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{
+		defaultLimit: DEFAULT_RATE_LIMIT,
+		limits:       map[string]RateLimit{},
+		buckets:      map[string]*bucket{},
+	}
+}
+
+// (*hostLimiter) limitFor(host): returns the limit for requests to host.
+func (l *hostLimiter) limitFor(host string) RateLimit {
+	if limit, ok := l.limits[host]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+// (*hostLimiter) wait(ctx, host): waits until a request to host is allowed,
+// or until ctx is done. Returns ctx's error if it is done first, and
+// ErrRateLimitWait straight away if the wait would outlast ctx's deadline.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	limit := l.limitFor(host)
+	if limit.Every <= 0 {
+		return nil
+	}
+
+	// The request takes its token straight away, even if that leaves the
+	// bucket in debt, and then waits for the debt to be paid off. That way
+	// waiting requests go in the order they arrived instead of racing each
+	// other for every new token.
+	l.mu.Lock()
+	now := time.Now()
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &bucket{tokens: float64(max(limit.Burst, 1)), updatedAt: now}
+		l.buckets[host] = b
+	}
+	b.tokens = min(float64(max(limit.Burst, 1)), b.tokens+float64(now.Sub(b.updatedAt))/float64(limit.Every))
+	b.updatedAt = now
+	b.tokens--
+	wait := time.Duration(-b.tokens * float64(limit.Every))
+	// There's no point queueing behind other requests only to be canceled, and
+	// a caller with a deadline would rather know now.
+	if deadline, ok := ctx.Deadline(); ok && wait > 0 && now.Add(wait).After(deadline) {
+		b.tokens++
+		l.mu.Unlock()
+		return ErrRateLimitWait
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	if err := sleep(ctx, wait); err != nil {
+		// The request isn't going to be made, so its token goes back.
+		l.mu.Lock()
+		b.tokens++
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package dineocclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestLimiter(limit): returns a hostLimiter with limit for every host.
+func newTestLimiter(limit RateLimit) *hostLimiter {
+	limiter := newHostLimiter()
+	limiter.defaultLimit = limit
+	return limiter
+}
+
+func TestHostLimiterBurst(t *testing.T) {
+	limiter := newTestLimiter(RateLimit{Burst: 3, Every: time.Hour})
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.wait(ctx, "example.com"); err != nil {
+			t.Fatalf("wait %d: %v", i+1, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("a burst of 3 took %v, want no wait", elapsed)
+	}
+
+	// The bucket is empty now, so the next request would wait an hour.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx, "example.com"); !errors.Is(err, ErrRateLimitWait) {
+		t.Errorf("wait on an empty bucket = %v, want ErrRateLimitWait", err)
+	}
+}
+
+func TestHostLimiterPacing(t *testing.T) {
+	const every = 20 * time.Millisecond
+	limiter := newTestLimiter(RateLimit{Burst: 1, Every: every})
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limiter.wait(ctx, "example.com"); err != nil {
+			t.Fatalf("wait %d: %v", i+1, err)
+		}
+	}
+	// The first request is free, and each one after it waits its turn.
+	if elapsed := time.Since(start); elapsed < 4*every-5*time.Millisecond {
+		t.Errorf("5 requests took %v, want at least %v", elapsed, 4*every)
+	}
+}
+
+func TestHostLimiterHostsAreSeparate(t *testing.T) {
+	limiter := newTestLimiter(RateLimit{Burst: 1, Every: time.Hour})
+	limiter.limits["unlimited.example.com"] = RateLimit{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.wait(ctx, "a.example.com"); err != nil {
+		t.Fatalf("wait for a.example.com: %v", err)
+	}
+	if err := limiter.wait(ctx, "b.example.com"); err != nil {
+		t.Errorf("wait for b.example.com = %v, want its own bucket", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := limiter.wait(ctx, "unlimited.example.com"); err != nil {
+			t.Fatalf("wait for an unlimited host = %v", err)
+		}
+	}
+}
+
+func TestHostLimiterReturnsTokenOnCancel(t *testing.T) {
+	const every = 100 * time.Millisecond
+	limiter := newTestLimiter(RateLimit{Burst: 1, Every: every})
+
+	if err := limiter.wait(context.Background(), "example.com"); err != nil {
+		t.Fatalf("first wait: %v", err)
+	}
+
+	// A request that gives up while waiting shouldn't leave the bucket in its
+	// debt, or everyone after it would wait for a request that never happened.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	if err := limiter.wait(ctx, "example.com"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled wait = %v, want context.Canceled", err)
+	}
+
+	start := time.Now()
+	if err := limiter.wait(context.Background(), "example.com"); err != nil {
+		t.Fatalf("wait after cancel: %v", err)
+	}
+	// With the canceled request's token back this is one request's wait, not
+	// two.
+	if elapsed := time.Since(start); elapsed > every*3/2 {
+		t.Errorf("wait after a canceled wait took %v, want about %v", elapsed, every)
+	}
+}
+
+func TestHostLimiterReturnsTokenPastDeadline(t *testing.T) {
+	limiter := newTestLimiter(RateLimit{Burst: 1, Every: time.Hour})
+	if err := limiter.wait(context.Background(), "example.com"); err != nil {
+		t.Fatalf("first wait: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := limiter.wait(ctx, "example.com"); !errors.Is(err, ErrRateLimitWait) {
+			t.Fatalf("wait past the deadline = %v, want ErrRateLimitWait", err)
+		}
+	}
+
+	// Refused requests take nothing, so the next one is only an hour out.
+	limiter.mu.Lock()
+	tokens := limiter.buckets["example.com"].tokens
+	limiter.mu.Unlock()
+	if tokens < -0.01 {
+		t.Errorf("bucket has %v tokens after refused waits, want about 0", tokens)
+	}
+}
+
+func TestClientRateLimitDeadline(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"buildings": []}`))
+	}, WithRateLimit(RateLimit{Burst: 1, Every: time.Hour}))
+
+	if _, err := client.GetFoodBuildings(context.Background(), "site"); err != nil {
+		t.Fatalf("first GetFoodBuildings: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.GetFoodBuildings(ctx, "site"); !errors.Is(err, ErrRateLimitWait) {
+		t.Errorf("GetFoodBuildings = %v, want ErrRateLimitWait", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("GetFoodBuildings took %v to fail, want it to fail straight away", elapsed)
+	}
+}
@@ -0,0 +1,154 @@
+package dineocclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The retry policy clients use unless given another with WithRetry.
+var DEFAULT_RETRY_POLICY = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// EXPORTED TYPES: MAY BE USED BY IMPORTING MODULES
+
+// RetryPolicy decides how a client retries a request that failed in a way
+// that might not happen again: a 429, a 5xx, or a timeout. Before attempt n+1
+// the client waits a random time between 0 and BaseDelay*2^(n-1), capped at
+// MaxDelay, unless dineoncampus said how long to wait with Retry-After. A
+// Retry-After longer than MaxDelay isn't waited out, the error is returned
+// instead.
+type RetryPolicy struct {
+	// How many times a request is tried in total. Zero or one means requests
+	// are never retried.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Attempt describes one try at a request, for an AttemptObserver.
+type Attempt struct {
+	URL string
+	// Starts at 1.
+	Number int
+	// nil if the attempt succeeded.
+	Err error
+	// Whether the request will be tried again, and how long the client waits
+	// before it is.
+	Retrying bool
+	Wait     time.Duration
+}
+
+// AttemptObserver is called after every attempt a client makes at a request,
+// such as to log or count retries.
+type AttemptObserver func(Attempt)
+
+// EXPORTED FUNCTIONS: MAY BE USED BY IMPORTING MODULES
+
+// WithRetry(policy): makes the client retry requests according to policy.
+// WithRetry(RetryPolicy{}) turns retries off.
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithAttemptObserver(observer): makes the client call observer after every
+// attempt at a request.
+func WithAttemptObserver(observer AttemptObserver) Option {
+	return func(c *Client) {
+		c.observer = observer
+	}
+}
+
+// NON-EXPORTED FUNCTIONS: MAY NOT BE USED BY IMPORTING MODULES
+
+// (RetryPolicy) backoff(attempt): returns how long to wait after the given
+// failed attempt, with full jitter so that many clients failing at once don't
+// all come back at once.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// (RetryPolicy) delay(attempt, err): returns whether a request that failed
+// with err on the given attempt should be tried again, and how long to wait
+// first.
+func (p RetryPolicy) delay(attempt int, err error) (bool, time.Duration) {
+	if attempt >= p.MaxAttempts || !isRetryable(err) {
+		return false, 0
+	}
+
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.RetryAfter > 0 {
+		if upstreamErr.RetryAfter > p.MaxDelay {
+			return false, 0
+		}
+		return true, upstreamErr.RetryAfter
+	}
+
+	return true, p.backoff(attempt)
+}
+
+// isRetryable(err): reports whether a request that failed with err might
+// succeed if tried again. Every request the client makes is a GET, so trying
+// one again is always safe.
+func isRetryable(err error) bool {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.StatusCode == http.StatusTooManyRequests ||
+			upstreamErr.StatusCode >= 500
+	}
+
+	// The caller giving up isn't something a retry can fix.
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// parseRetryAfter(header): returns how long a Retry-After header asks us to
+// wait, which is either a number of seconds or an HTTP date. Returns 0 if the
+// header is missing or unparseable.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// sleep(ctx, d): waits for d, or until ctx is done. Returns ctx's error if it
+// is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
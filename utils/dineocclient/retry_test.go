@@ -0,0 +1,187 @@
+package dineocclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	tests := []struct {
+		attempt int
+		cap     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, test := range tests {
+		// The delay is random, so check that many of them stay under the cap.
+		for i := 0; i < 100; i++ {
+			delay := policy.backoff(test.attempt)
+			if delay < 0 || delay > test.cap {
+				t.Fatalf("backoff(%d) = %v, want between 0 and %v", test.attempt, delay, test.cap)
+			}
+		}
+	}
+
+	if delay := (RetryPolicy{MaxAttempts: 3}).backoff(1); delay != 0 {
+		t.Errorf("backoff with no delays = %v, want 0", delay)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Second}
+	upstream := func(status int, retryAfter time.Duration) error {
+		return &UpstreamError{StatusCode: status, RetryAfter: retryAfter}
+	}
+
+	tests := []struct {
+		name     string
+		attempt  int
+		err      error
+		retrying bool
+		wait     time.Duration
+	}{
+		{name: "server error", attempt: 1, err: upstream(http.StatusInternalServerError, 0), retrying: true},
+		{name: "bad gateway", attempt: 2, err: upstream(http.StatusBadGateway, 0), retrying: true},
+		{name: "rate limited", attempt: 1, err: upstream(http.StatusTooManyRequests, 0), retrying: true},
+		{name: "retry after", attempt: 1, err: upstream(http.StatusTooManyRequests, 5*time.Second), retrying: true, wait: 5 * time.Second},
+		{name: "retry after too long", attempt: 1, err: upstream(http.StatusServiceUnavailable, time.Minute)},
+		{name: "last attempt", attempt: 3, err: upstream(http.StatusInternalServerError, 0)},
+		{name: "not found", attempt: 1, err: upstream(http.StatusNotFound, 0)},
+		{name: "blocked", attempt: 1, err: upstream(http.StatusForbidden, 0)},
+		{name: "bad request", attempt: 1, err: upstream(http.StatusBadRequest, 0)},
+		{name: "canceled", attempt: 1, err: context.Canceled},
+		{name: "other error", attempt: 1, err: errors.New("unexpected end of JSON input")},
+	}
+	for _, test := range tests {
+		retrying, wait := policy.delay(test.attempt, test.err)
+		if retrying != test.retrying {
+			t.Errorf("%s: delay retrying = %v, want %v", test.name, retrying, test.retrying)
+		}
+		if test.wait != 0 && wait != test.wait {
+			t.Errorf("%s: delay wait = %v, want %v", test.name, wait, test.wait)
+		}
+		if wait > policy.MaxDelay {
+			t.Errorf("%s: delay wait = %v, more than MaxDelay", test.name, wait)
+		}
+	}
+
+	if retrying, _ := (RetryPolicy{}).delay(1, upstream(http.StatusInternalServerError, 0)); retrying {
+		t.Error("the zero RetryPolicy retried")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"120", 2 * time.Minute},
+		{"-5", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, test := range tests {
+		if got := parseRetryAfter(test.header); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+
+	// An HTTP date only has whole seconds, so allow for some rounding.
+	header := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(header); got < 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, want about 1m", header, got)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var requests atomic.Int32
+	var attempts []Attempt
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"buildings": []}`))
+	},
+		WithRetry(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithAttemptObserver(func(attempt Attempt) { attempts = append(attempts, attempt) }),
+	)
+
+	if _, err := client.GetFoodBuildings(context.Background(), "site"); err != nil {
+		t.Fatalf("GetFoodBuildings: %v", err)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("%d attempts, want 3", len(attempts))
+	}
+	for i, attempt := range attempts[:2] {
+		if attempt.Number != i+1 || !attempt.Retrying || !errors.Is(attempt.Err, ErrUpstream) {
+			t.Errorf("attempt %d = %+v, want a retried upstream error", i+1, attempt)
+		}
+	}
+	if last := attempts[2]; last.Err != nil || last.Retrying {
+		t.Errorf("attempt 3 = %+v, want a success", last)
+	}
+}
+
+func TestClientDoesNotRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		want       error
+	}{
+		{"not found", http.StatusNotFound, "", ErrNotFound},
+		{"blocked", http.StatusForbidden, "", ErrBlocked},
+		{"retry after too long", http.StatusTooManyRequests, "3600", ErrRateLimited},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int32
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(test.status)
+			}, WithRetry(RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Second}))
+
+			_, err := client.GetFoodBuildings(context.Background(), "site")
+			if !errors.Is(err, test.want) {
+				t.Errorf("GetFoodBuildings = %v, want %v", err, test.want)
+			}
+			if n := requests.Load(); n != 1 {
+				t.Errorf("%d requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestClientGivesUpAfterMaxAttempts(t *testing.T) {
+	var requests atomic.Int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}, WithRetry(RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}))
+
+	_, err := client.GetFoodBuildings(context.Background(), "site")
+	if !errors.Is(err, ErrUpstream) {
+		t.Errorf("GetFoodBuildings = %v, want ErrUpstream", err)
+	}
+	if n := requests.Load(); n != 4 {
+		t.Errorf("%d requests, want 4", n)
+	}
+}
@@ -1,3 +1,16 @@
 module github.com/david-callender/FoodFinder/utils
 
 go 1.25.1
+
+require github.com/wneessen/go-mail v0.7.2
+
+require (
+	github.com/jackc/pgx/v5 v5.7.6
+	golang.org/x/text v0.29.0
+)
+
+require (
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
+	golang.org/x/crypto v0.37.0 // indirect
+)
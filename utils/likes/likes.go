@@ -0,0 +1,67 @@
+package likes
+
+import (
+	"context"
+
+	"github.com/david-callender/FoodFinder/utils/matcher"
+	"github.com/jackc/pgx/v5"
+)
+
+// Ratings at or above this count as liking the meal, both for the
+// recommender and for the backend leaving meals a user already likes out of
+// their recommendations.
+const LIKED_RATING = 4
+
+// EXPORTED TYPES: MAY BE USED BY IMPORTING MODULES
+
+// Querier is anything queries can be run on, such as a *pgx.Conn or a
+// *pgxpool.Pool.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// EXPORTED FUNCTIONS: MAY BE USED BY IMPORTING MODULES
+
+// LoadUserMatchers(ctx, db): takes something to query the database with and
+// returns a mapping from integer user ids to a matcher for their preference
+// rules. Users whose rules don't compile are left out, and their errors are
+// returned in a second mapping instead so that one bad rule doesn't hold up
+// everyone else. Returns nil maps and non-nil error on failure.
+func LoadUserMatchers(ctx context.Context, db Querier) (map[int]*matcher.Matcher, map[int]error, error) {
+	prefRows, err := db.Query(
+		ctx,
+		`SELECT "user", preference, "matchType", location, mealtime
+			FROM "Preferences";`,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer prefRows.Close()
+
+	var userRules = make(map[int][]matcher.Rule)
+	for prefRows.Next() {
+		var userId int
+		var rule matcher.Rule
+		err = prefRows.Scan(&userId, &rule.Pattern, &rule.Type, &rule.Location, &rule.Mealtime)
+		if err != nil {
+			return nil, nil, err
+		}
+		userRules[userId] = append(userRules[userId], rule)
+	}
+	if err = prefRows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var userMatchers = make(map[int]*matcher.Matcher)
+	var invalid = make(map[int]error)
+	for userId, rules := range userRules {
+		userMatcher, err := matcher.Compile(rules)
+		if err != nil {
+			invalid[userId] = err
+			continue
+		}
+		userMatchers[userId] = userMatcher
+	}
+
+	return userMatchers, invalid, nil
+}
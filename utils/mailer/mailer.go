@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"errors"
+	"os"
+
+	"github.com/wneessen/go-mail"
+)
+
+// Global config variables that we ought to move out to a config file
+const EMAIL_HOST = "<EMAIL_SERVER_HOSTNAME>"
+
+var ErrNoEmail = errors.New("mailer: NOTIFIER_EMAIL is not set, we don't have an email address")
+var ErrNoPass = errors.New("mailer: NOTIFIER_PASSWORD is not set, we cannot authenticate with no password")
+
+// EXPORTED TYPES: MAY BE USED BY IMPORTING MODULES
+
+// Sender is anything that can deliver a batch of messages. Modules that send
+// mail should depend on a Sender rather than calling Send directly so that
+// they can be run without an SMTP account.
+type Sender interface {
+	Send(messages ...*mail.Msg) error
+}
+
+// SMTPSender sends mail through EMAIL_HOST using the credentials in the
+// NOTIFIER_EMAIL and NOTIFIER_PASSWORD environment variables.
+type SMTPSender struct{}
+
+// EXPORTED FUNCTIONS: MAY BE USED BY IMPORTING MODULES
+
+// NewMessage(to, subject, body): Takes a recipient address, a subject line and
+// a plain text body and returns a message sent from NOTIFIER_EMAIL. Returns a
+// nil message and non-nil error on failure.
+func NewMessage(to, subject, body string) (*mail.Msg, error) {
+	message := mail.NewMsg()
+	errs := errors.Join(
+		message.From(os.Getenv("NOTIFIER_EMAIL")),
+		message.ToFromString(to),
+	)
+	if errs != nil {
+		return nil, errs
+	}
+	message.Subject(subject)
+	message.SetBodyString("text/plain", body)
+
+	return message, nil
+}
+
+// Send(messages): takes a slice of references to mail.Msg emails, obtains
+// its email address and password from the environment, and uses the credentials
+// to send all of the messages. Returns non-nil error on failure.
+func Send(messages ...*mail.Msg) error {
+	notifierEmail := os.Getenv("NOTIFIER_EMAIL")
+	if notifierEmail == "" {
+		return ErrNoEmail
+	}
+	notifierPassword := os.Getenv("NOTIFIER_PASSWORD")
+	if notifierPassword == "" {
+		return ErrNoPass
+	}
+	mailer, err := mail.NewClient(
+		EMAIL_HOST,
+		mail.WithUsername(notifierEmail),
+		mail.WithPassword(notifierPassword),
+		mail.WithSMTPAuth(mail.SMTPAuthPlain),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = mailer.DialAndSend(messages...); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// (SMTPSender) Send(messages): calls Send(messages).
+func (SMTPSender) Send(messages ...*mail.Msg) error {
+	return Send(messages...)
+}
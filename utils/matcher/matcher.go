@@ -0,0 +1,189 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/cases"
+)
+
+// Longest pattern a rule may have. Regexes are compiled with RE2 so they can't
+// blow up, but there's no reason for a meal pattern to be longer than this.
+const MAX_PATTERN_LENGTH = 200
+
+var ErrEmptyPattern = errors.New("matcher: pattern is empty")
+var ErrPatternTooLong = fmt.Errorf("matcher: pattern is longer than %d characters", MAX_PATTERN_LENGTH)
+var ErrUnknownMatchType = errors.New("matcher: unknown match type")
+
+// EXPORTED TYPES: MAY BE USED BY IMPORTING MODULES
+
+// MatchType is how a rule's pattern is compared to meals. Every match type
+// but ID ignores case.
+type MatchType string
+
+const (
+	// The meal name is the pattern, ignoring surrounding whitespace.
+	Exact MatchType = "exact"
+	// The pattern appears anywhere in the meal name.
+	Contains MatchType = "contains"
+	// The pattern appears in the meal name as whole words, so "chicken"
+	// matches "Orange Chicken" but not "Chickenpea Salad".
+	Word MatchType = "word"
+	// The pattern is a regular expression (RE2 syntax) that matches some
+	// part of the meal name.
+	Regex MatchType = "regex"
+	// The pattern is a dineoncampus meal ID, so the rule keeps matching the
+	// meal if it's renamed.
+	ID MatchType = "id"
+)
+
+// Rule is a single preference. A nil Location or Mealtime matches meals served
+// at any location or mealtime.
+type Rule struct {
+	Pattern  string
+	Type     MatchType
+	Location *string
+	Mealtime *int16
+}
+
+// Item is a meal being served somewhere, as found in the DocCache table.
+type Item struct {
+	Name     string
+	ID       string
+	Location string
+	Mealtime int16
+}
+
+// Matcher checks meals against a set of rules.
+type Matcher struct {
+	rules []compiledRule
+}
+
+// NON-EXPORTED TYPES: MAY NOT BE USED BY IMPORTING MODULES
+
+type compiledRule struct {
+	Rule
+	normalized string         // set for exact, contains and id rules
+	regex      *regexp.Regexp // set for word and regex rules
+}
+
+var folder = cases.Fold()
+
+// EXPORTED FUNCTIONS: MAY BE USED BY IMPORTING MODULES
+
+// Normalize(name): returns name case folded, with surrounding whitespace
+// removed and runs of inner whitespace collapsed into single spaces. Two meal
+// names that normalize the same are the same meal as far as an exact rule is
+// concerned.
+func Normalize(name string) string {
+	return folder.String(strings.Join(strings.Fields(name), " "))
+}
+
+// Validate(rule): returns a non-nil error if rule could not be compiled.
+func Validate(rule Rule) error {
+	_, err := compile(rule)
+	return err
+}
+
+// Compile(rules): Takes a set of rules and returns a Matcher that matches
+// meals matching any of them. Returns a nil Matcher and non-nil error if any
+// of the rules is invalid.
+func Compile(rules []Rule) (*Matcher, error) {
+	matcher := &Matcher{rules: make([]compiledRule, 0, len(rules))}
+	for _, rule := range rules {
+		compiled, err := compile(rule)
+		if err != nil {
+			return nil, err
+		}
+		matcher.rules = append(matcher.rules, compiled)
+	}
+	return matcher, nil
+}
+
+// (*Matcher) Match(item): reports whether any of the matcher's rules match
+// item. A nil Matcher matches nothing.
+func (m *Matcher) Match(item Item) bool {
+	_, ok := m.MatchingRule(item)
+	return ok
+}
+
+// (*Matcher) MatchingRule(item): returns the first of the matcher's rules
+// that matches item, and whether there was one.
+func (m *Matcher) MatchingRule(item Item) (Rule, bool) {
+	if m == nil {
+		return Rule{}, false
+	}
+
+	// Normalizing is only worth doing once per item.
+	normalized := Normalize(item.Name)
+	for _, rule := range m.rules {
+		if rule.matches(item, normalized) {
+			return rule.Rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// NON-EXPORTED FUNCTIONS: MAY NOT BE USED BY IMPORTING MODULES
+
+// compile(rule): checks rule and prepares its pattern for matching.
+func compile(rule Rule) (compiledRule, error) {
+	compiled := compiledRule{Rule: rule}
+
+	if strings.TrimSpace(rule.Pattern) == "" {
+		return compiled, ErrEmptyPattern
+	}
+	if len(rule.Pattern) > MAX_PATTERN_LENGTH {
+		return compiled, ErrPatternTooLong
+	}
+
+	var err error
+	switch rule.Type {
+	case Exact, Contains:
+		compiled.normalized = Normalize(rule.Pattern)
+	case ID:
+		compiled.normalized = strings.TrimSpace(rule.Pattern)
+	case Word:
+		// Words are matched against the normalized name, so the pattern is
+		// normalized the same way before it's escaped.
+		compiled.regex, err = regexp.Compile(
+			`(?:^|[^\pL\pN])` + regexp.QuoteMeta(Normalize(rule.Pattern)) + `(?:[^\pL\pN]|$)`,
+		)
+	case Regex:
+		compiled.regex, err = regexp.Compile("(?i)" + rule.Pattern)
+	default:
+		return compiled, fmt.Errorf("%w: %q", ErrUnknownMatchType, rule.Type)
+	}
+	if err != nil {
+		return compiled, fmt.Errorf("matcher: invalid pattern: %w", err)
+	}
+
+	return compiled, nil
+}
+
+// (compiledRule) matches(item, normalized): reports whether the rule matches
+// item, whose normalized name is normalized.
+func (r compiledRule) matches(item Item, normalized string) bool {
+	if r.Location != nil && *r.Location != item.Location {
+		return false
+	}
+	if r.Mealtime != nil && *r.Mealtime != item.Mealtime {
+		return false
+	}
+
+	switch r.Type {
+	case Exact:
+		return normalized == r.normalized
+	case Contains:
+		return strings.Contains(normalized, r.normalized)
+	case Word:
+		return r.regex.MatchString(normalized)
+	case Regex:
+		return r.regex.MatchString(item.Name)
+	case ID:
+		return item.ID == r.normalized
+	}
+	return false
+}